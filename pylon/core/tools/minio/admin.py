@@ -35,17 +35,36 @@ class MinIOAdminCrypt:
             os.path.join(os.path.dirname(__file__), "minio_madmin.so")
         )
         self.lib.decrypt.argtypes = [ctypes.c_char_p, ctypes.c_char_p]
-        self.lib.decrypt.restype = ctypes.c_char_p
+        self.lib.decrypt.restype = ctypes.c_void_p
         self.lib.encrypt.argtypes = [ctypes.c_char_p, ctypes.c_char_p]
-        self.lib.encrypt.restype = ctypes.c_char_p
+        self.lib.encrypt.restype = ctypes.c_void_p
+        self.lib.free_cstring.argtypes = [ctypes.c_void_p]
+        self.lib.free_cstring.restype = None
+        self.lib.madmin_shutdown.argtypes = []
+        self.lib.madmin_shutdown.restype = ctypes.c_int
+
+    def _take_string(self, ptr):
+        """ Copy returned C string and free it """
+        try:
+            return ctypes.string_at(ptr)
+        finally:
+            self.lib.free_cstring(ptr)
 
     def encrypt(self, data):
         """ Encrypt data  """
-        return binascii.unhexlify(self.lib.encrypt(self.key.encode(), binascii.hexlify(data)))
+        return binascii.unhexlify(
+            self._take_string(self.lib.encrypt(self.key.encode(), binascii.hexlify(data)))
+        )
 
     def decrypt(self, data):
         """ Decrypt data """
-        return binascii.unhexlify(self.lib.decrypt(self.key.encode(), binascii.hexlify(data)))
+        return binascii.unhexlify(
+            self._take_string(self.lib.decrypt(self.key.encode(), binascii.hexlify(data)))
+        )
+
+    def shutdown(self):
+        """ Release library global state before unloading, returns handles left open """
+        return self.lib.madmin_shutdown()
 
 
 class MinIOAdminAuth(requests.auth.AuthBase):  # pylint: disable=R0903
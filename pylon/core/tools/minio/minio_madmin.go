@@ -14,37 +14,1050 @@ package main
 //   See the License for the specific language governing permissions and
 //   limitations under the License.
 
+// #include <stdlib.h>
+// #include <string.h>
 import "C"
 import (
   "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "encoding/base64"
   "encoding/hex"
+  "errors"
+  "io"
+  "io/ioutil"
+  "strings"
+  "unsafe"
   "github.com/minio/minio/pkg/madmin"
+  "github.com/secure-io/sio-go"
+  "github.com/secure-io/sio-go/sioutil"
+  "golang.org/x/crypto/argon2"
+  "golang.org/x/crypto/chacha20poly1305"
 )
 
+// Every *C.char returned by the exports below is allocated with C.CString
+// and owned by the caller, which must release it with free_cstring
+
+// All exports may be called from several threads at once. Per-call state
+// (keys, salts, buffers, streams) is local to the call, the only shared
+// state is the handle registry, which is locked
+
+// Status codes reported by the *_ex exports, last_error gives the message
+// behind them. The values are part of the library interface and must
+// never be renumbered:
+//
+//   0 - STATUS_OK           success (the output may legitimately be empty,
+//                           empty ciphertext decrypts to empty cleartext)
+//   1 - STATUS_BAD_HEX      input is not a valid hex (or base64) string
+//   2 - STATUS_AUTH_FAILED  ciphertext is not authentic (wrong key or modified data)
+//   3 - STATUS_MALFORMED    ciphertext is too short or has an unknown header
+//   4 - STATUS_INTERNAL     any other failure
+//   5 - STATUS_IO_ERROR     file could not be opened, read or written
+//   6 - STATUS_UNSUPPORTED  requested algorithm or option is not supported
+//   7 - STATUS_BUFFER_SMALL caller provided buffer can not hold the result
+//   8 - STATUS_OUT_OF_RANGE requested range is outside of the cleartext
+//   9 - STATUS_TOO_LARGE    output would exceed the caller's limit or the format's
+//  10 - STATUS_KEY_FILE     secret key file is missing, unreadable or empty
+//  11 - STATUS_CANCELLED    operation was cancelled or timed out
+//  12 - STATUS_BAD_ARG      required argument is NULL or invalid, e.g. empty secret key
+//  13 - STATUS_TAG_LENGTH   authentication tags are not the 16 bytes of the format
+//  14 - STATUS_WRONG_KEY    first package is not authentic, most likely wrong key
+//  15 - STATUS_CORRUPT      a later package is not authentic, data was modified
+//  16 - STATUS_TRUNCATED    ciphertext ends in the middle of the header or a package
+//  17 - STATUS_BAD_HANDLE   handle is unknown, released or of another kind or direction
+//
+// An AEAD can not tell a wrong key from modified data. decrypt_ex makes a
+// best-effort split of STATUS_AUTH_FAILED: once the first package
+// authenticates the key is known to be right, so a later failure means
+// modified (or reordered, truncated) data. A failing first package is
+// reported as corrupt when the second one opens on its own, otherwise as a
+// wrong key, although a modified header or single package looks the same.
+// decrypt_ex also reports cut input as STATUS_TRUNCATED, see
+// truncated_status. The other exports keep reporting STATUS_AUTH_FAILED
+const (
+  STATUS_OK          = 0
+  STATUS_BAD_HEX     = 1
+  STATUS_AUTH_FAILED = 2
+  STATUS_MALFORMED   = 3
+  STATUS_INTERNAL    = 4
+  STATUS_IO_ERROR    = 5
+  STATUS_UNSUPPORTED = 6
+  STATUS_BUFFER_SMALL = 7
+  STATUS_OUT_OF_RANGE = 8
+  STATUS_TOO_LARGE    = 9
+  STATUS_KEY_FILE     = 10
+  STATUS_CANCELLED    = 11
+  STATUS_BAD_ARG      = 12
+  STATUS_TAG_LENGTH   = 13
+  STATUS_WRONG_KEY    = 14
+  STATUS_CORRUPT      = 15
+  STATUS_TRUNCATED    = 16
+  STATUS_BAD_HANDLE   = 17
+)
+
+// madmin ciphertext layout: salt (32) | AEAD ID (1) | nonce (8) | data.
+// Data is a sio stream of packages, each holding up to package_payload
+// bytes followed by a package_overhead bytes tag
+const (
+  header_size      = 32 + 1 + 8
+  aead_aes_gcm     = 0x00
+  aead_c20p1305    = 0x01
+  package_payload  = sio.BufSize
+  package_overhead = 16
+  package_size     = package_payload + package_overhead
+)
+
+// sio numbers packages with a 32 bit counter starting at 1, which caps a
+// stream of default packages at max_payload bytes, about 64 TiB
+const max_payload = (1 << 32 - 1) * int64(package_payload)
+
+// check_payload refuses cleartext of length bytes that does not fit one
+// stream of chunk_size byte packages with STATUS_TOO_LARGE
+func check_payload(length int64, chunk_size int) int {
+  if length > (1 << 32 - 1) * int64(chunk_size) {
+    return fail(STATUS_TOO_LARGE, sio.ErrExceeded)
+  }
+  return STATUS_OK
+}
+
+// The stream helpers below produce and consume exactly the same format
+// as madmin.EncryptData/DecryptData, but without buffering the payload
+
+// Argon2id cost parameters used by madmin to derive the stream key
+const (
+  argon2_time    = 1
+  argon2_memory  = 64 * 1024
+  argon2_threads = 4
+  argon2_key_len = 32
+)
+
+func new_stream(secret_key []byte, salt []byte, id byte) (*sio.Stream, error) {
+  return new_chunked_stream(secret_key, salt, id, package_payload)
+}
+
+// new_chunked_stream is new_stream with chunk_size bytes packages instead of
+// the default package_payload. The size is not stored in the ciphertext
+func new_chunked_stream(secret_key []byte, salt []byte, id byte, chunk_size int) (*sio.Stream, error) {
+  aead, err := new_aead(secret_key, salt, id)
+  if err != nil {
+    return nil, err
+  }
+  return sio.NewStream(aead, chunk_size), nil
+}
+
+// new_aead derives the stream key the way madmin does and returns the
+// AEAD id cipher under it
+func new_aead(secret_key []byte, salt []byte, id byte) (cipher.AEAD, error) {
+  if id != aead_aes_gcm && id != aead_c20p1305 {
+    return nil, errors.New("invalid AEAD algorithm ID")
+  }
+  key := argon2.IDKey(secret_key, salt, argon2_time, argon2_memory, argon2_threads, argon2_key_len)
+  defer wipe(key)
+  return key_aead(key, id)
+}
+
+// key_aead returns the AEAD id cipher under an already derived key
+func key_aead(key []byte, id byte) (cipher.AEAD, error) {
+  switch id {
+  case aead_aes_gcm, aead_pbkdf2_aes_gcm:
+    block, err := aes.NewCipher(key)
+    if err != nil {
+      return nil, err
+    }
+    return cipher.NewGCM(block)
+  case aead_c20p1305:
+    return chacha20poly1305.New(key)
+  }
+  return nil, errors.New("invalid AEAD algorithm ID")
+}
+
+// default_aead picks AES-GCM only if there is an optimized implementation,
+// same as madmin
+func default_aead() byte {
+  if sioutil.NativeAES() {
+    return aead_aes_gcm
+  }
+  return aead_c20p1305
+}
+
+// encrypt_writer writes the header to w and returns a writer encrypting into w,
+// binding optional associated data aad. Closing the returned writer finalizes
+// the stream but does not close w
+func encrypt_writer(secret_key []byte, w io.Writer, id byte, aad []byte) (io.WriteCloser, error) {
+  return encrypt_chunked_writer(secret_key, w, id, aad, package_payload)
+}
+
+func encrypt_chunked_writer(secret_key []byte, w io.Writer, id byte, aad []byte, chunk_size int) (io.WriteCloser, error) {
+  return encrypt_seeded_writer(secret_key, w, id, aad, chunk_size, sioutil.MustRandom(32), sioutil.MustRandom(8))
+}
+
+// encrypt_seeded_writer takes the salt (32 bytes) and nonce (8 bytes)
+// instead of generating them. They must never repeat for the same key
+func encrypt_seeded_writer(secret_key []byte, w io.Writer, id byte, aad []byte, chunk_size int, salt []byte, nonce []byte) (io.WriteCloser, error) {
+  stream, err := new_chunked_stream(secret_key, salt, id, chunk_size)
+  if err != nil {
+    return nil, err
+  }
+  return stream_writer(stream, w, id, aad, salt, nonce)
+}
+
+// stream_writer writes the header to w and returns a writer encrypting
+// into w with an already keyed stream
+func stream_writer(stream *sio.Stream, w io.Writer, id byte, aad []byte, salt []byte, nonce []byte) (io.WriteCloser, error) {
+  header := append(append(append([]byte{}, salt...), id), nonce...)
+  if _, err := w.Write(header); err != nil {
+    return nil, err
+  }
+  // sio closes the underlying writer if it can, hide Close from it
+  return stream.EncryptWriter(struct{ io.Writer }{w}, nonce, aad), nil
+}
+
+// decrypt_reader reads the header from r and returns a reader decrypting r,
+// which fails authentication unless aad matches the one used to encrypt
+func decrypt_reader(secret_key []byte, r io.Reader, aad []byte) (io.Reader, int) {
+  return decrypt_chunked_reader(secret_key, r, aad, package_payload)
+}
+
+// An r without any bytes is the empty case of empty_ciphertext and gives
+// an empty reader
+func decrypt_chunked_reader(secret_key []byte, r io.Reader, aad []byte, chunk_size int) (io.Reader, int) {
+  header := make([]byte, header_size)
+  if _, err := io.ReadFull(r, header); err == io.EOF {
+    return bytes.NewReader(nil), STATUS_OK
+  } else if err == io.ErrUnexpectedEOF {
+    return nil, fail(STATUS_MALFORMED, err)
+  } else if err != nil {
+    return nil, fail(STATUS_IO_ERROR, err)
+  }
+  stream, err := new_chunked_stream(secret_key, header[:32], header[32], chunk_size)
+  if err != nil {
+    return nil, fail(STATUS_MALFORMED, err)
+  }
+  return stream.DecryptReader(r, header[33:], aad), STATUS_OK
+}
+
+// stream_status maps an error returned while copying a stream to a status
+func stream_status(err error) int {
+  if err == madmin.ErrMaliciousData {
+    return fail(STATUS_AUTH_FAILED, err)
+  }
+  if err == sio.ErrExceeded {
+    return fail(STATUS_TOO_LARGE, err)
+  }
+  return fail(STATUS_IO_ERROR, err)
+}
+
+func encrypt_aead(secret_key []byte, cleartext []byte, id byte, aad []byte) ([]byte, int) {
+  var buffer bytes.Buffer
+  if status := encrypt_to(&buffer, secret_key, cleartext, id, aad); status != STATUS_OK {
+    return nil, status
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+// encrypt_to appends the ciphertext to buffer
+func encrypt_to(buffer *bytes.Buffer, secret_key []byte, cleartext []byte, id byte, aad []byte) int {
+  if status := check_payload(int64(len(cleartext)), package_payload); status != STATUS_OK {
+    return status
+  }
+  writer, err := encrypt_writer(secret_key, buffer, id, aad)
+  if err != nil {
+    return fail(STATUS_INTERNAL, err)
+  }
+  if _, err := writer.Write(cleartext); err != nil {
+    return fail(STATUS_INTERNAL, err)
+  }
+  if err := writer.Close(); err != nil {
+    return fail(STATUS_INTERNAL, err)
+  }
+  return STATUS_OK
+}
+
+func encrypt_raw(secret_key []byte, cleartext []byte) ([]byte, int) {
+  return encrypt_aead(secret_key, cleartext, default_aead(), nil)
+}
+
+// empty_ciphertext is the one check for empty input, made before the header
+// is looked at. No bytes at all are not a truncated ciphertext but a case
+// of their own: every decrypting export returns empty cleartext with
+// STATUS_OK for it, under any key. 1 to header_size - 1 bytes stay
+// STATUS_MALFORMED
+func empty_ciphertext(ciphertext []byte) bool {
+  return len(ciphertext) == 0
+}
+
+// check_header validates the ciphertext header without touching the payload
+func check_header(ciphertext []byte) int {
+  if len(ciphertext) < header_size {
+    return fail(STATUS_MALFORMED, errors.New("ciphertext shorter than header"))
+  }
+  if id := ciphertext[32]; id != aead_aes_gcm && id != aead_c20p1305 {
+    return fail(STATUS_MALFORMED, errors.New("invalid AEAD algorithm ID"))
+  }
+  return STATUS_OK
+}
+
+func decrypt_raw(secret_key []byte, ciphertext []byte) ([]byte, int) {
+  return decrypt_aead(secret_key, ciphertext, nil)
+}
+
+func decrypt_aead(secret_key []byte, ciphertext []byte, aad []byte) ([]byte, int) {
+  var buffer bytes.Buffer
+  if status := decrypt_to(&buffer, secret_key, ciphertext, aad); status != STATUS_OK {
+    wipe(buffer.Bytes())
+    return nil, status
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+// decrypt_to appends the cleartext to buffer, on failure buffer may hold
+// the cleartext of the packages before the bad one
+func decrypt_to(buffer *bytes.Buffer, secret_key []byte, ciphertext []byte, aad []byte) int {
+  aead, status := ciphertext_aead(secret_key, ciphertext)
+  if status != STATUS_OK || aead == nil {
+    return status
+  }
+  return decrypt_aead_to(buffer, aead, ciphertext, aad)
+}
+
+// ciphertext_aead checks the header and derives the AEAD of ciphertext,
+// which is nil for the empty ciphertext
+func ciphertext_aead(secret_key []byte, ciphertext []byte) (cipher.AEAD, int) {
+  if empty_ciphertext(ciphertext) {
+    return nil, STATUS_OK
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return nil, status
+  }
+  aead, err := new_aead(secret_key, ciphertext[:32], ciphertext[32])
+  if err != nil {
+    return nil, fail(STATUS_MALFORMED, err)
+  }
+  return aead, STATUS_OK
+}
+
+// decrypt_aead_to is decrypt_to under the AEAD derived for ciphertext
+func decrypt_aead_to(buffer *bytes.Buffer, aead cipher.AEAD, ciphertext []byte, aad []byte) int {
+  stream := sio.NewStream(aead, package_payload)
+  reader := stream.DecryptReader(bytes.NewReader(ciphertext[header_size:]), ciphertext[33:header_size], aad)
+  grow_output(buffer, ciphertext)
+  _, err := buffer.ReadFrom(reader)
+  if err == madmin.ErrMaliciousData {
+    return fail(STATUS_AUTH_FAILED, err)
+  }
+  if err != nil {
+    return fail(STATUS_INTERNAL, err)
+  }
+  return STATUS_OK
+}
+
+// grow_output makes room for all cleartext of ciphertext up front, which is
+// shorter than the ciphertext, plus the MinRead spare bytes ReadFrom wants.
+// Arrays abandoned while growing mid read would keep cleartext that
+// put_buffer can not wipe
+func grow_output(buffer *bytes.Buffer, ciphertext []byte) {
+  buffer.Grow(len(ciphertext) + bytes.MinRead)
+}
+
+func encrypt_data(secret_key []byte, cleartext_hex string) ([]byte, int) {
+  cleartext, err := decode_hex(cleartext_hex)
+  if err != nil {
+    return nil, STATUS_BAD_HEX
+  }
+  return encrypt_raw(secret_key, cleartext)
+}
+
+func decrypt_data(secret_key []byte, ciphertext_hex string) ([]byte, int) {
+  ciphertext, err := decode_hex(ciphertext_hex)
+  if err != nil {
+    return nil, STATUS_BAD_HEX
+  }
+  return decrypt_raw(secret_key, ciphertext)
+}
+
+// decode_hex ignores surrounding whitespace, a common copy-paste artifact
+func decode_hex(data string) ([]byte, error) {
+  result, err := hex.DecodeString(strings.TrimSpace(data))
+  if err != nil {
+    fail(STATUS_BAD_HEX, err)
+  }
+  return result, err
+}
+
+// decode_base64 accepts both standard and URL-safe alphabets, padded or not
+func decode_base64(data string) ([]byte, error) {
+  encoding := base64.StdEncoding
+  data = strings.TrimSpace(data)
+  if strings.ContainsAny(data, "-_") {
+    encoding = base64.URLEncoding
+  }
+  if !strings.HasSuffix(data, "=") && len(data) % 4 != 0 {
+    encoding = encoding.WithPadding(base64.NoPadding)
+  }
+  result, err := encoding.DecodeString(data)
+  if err != nil {
+    fail(STATUS_BAD_HEX, err)
+  }
+  return result, err
+}
+
+func rekey_data(old_key []byte, new_key []byte, ciphertext_hex string) ([]byte, int) {
+  cleartext, status := decrypt_data(old_key, ciphertext_hex)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  defer wipe(cleartext)
+  return encrypt_raw(new_key, cleartext)
+}
+
+// rekey_verified_data is rekey_data decrypting the new ciphertext again
+// under new_key and comparing it with the original cleartext
+func rekey_verified_data(old_key []byte, new_key []byte, ciphertext_hex string) ([]byte, int) {
+  cleartext, status := decrypt_data(old_key, ciphertext_hex)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  defer wipe(cleartext)
+  ciphertext, status := encrypt_raw(new_key, cleartext)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  check, status := decrypt_raw(new_key, ciphertext)
+  defer wipe(check)
+  if status != STATUS_OK {
+    return nil, fail(STATUS_INTERNAL, errors.New("re-encrypted ciphertext does not decrypt"))
+  }
+  if !bytes.Equal(check, cleartext) {
+    return nil, fail(STATUS_INTERNAL, errors.New("re-encrypted ciphertext does not match"))
+  }
+  return ciphertext, STATUS_OK
+}
+
+// wipe overwrites sensitive data in place
+func wipe(data []byte) {
+  for idx := range data {
+    data[idx] = 0
+  }
+}
+
+// c_secret copies a C string into a byte slice which, unlike a Go string,
+// can be wiped as soon as the call is done. NULL gives an empty key
+func c_secret(secret *C.char) []byte {
+  if secret == nil {
+    return nil
+  }
+  return C.GoBytes(unsafe.Pointer(secret), C.int(C.strlen(secret)))
+}
+
+// c_wipe overwrites a caller owned C string in place
+func c_wipe(ptr *C.char) {
+  if ptr != nil {
+    C.memset(unsafe.Pointer(ptr), 0, C.strlen(ptr))
+  }
+}
+
+// Exports check their pointer arguments up front with the helpers below,
+// a buggy binding then gets STATUS_BAD_ARG instead of crashing the process.
+// C.GoString maps NULL to "", so only required arguments need the check
+
+// c_no_key reports (and records) a NULL or empty secret key
+func c_no_key(secret *C.char) bool {
+  if secret == nil || *secret == 0 {
+    fail(STATUS_BAD_ARG, errors.New("secret key is NULL or empty"))
+    return true
+  }
+  return false
+}
+
+// c_null reports (and records) a NULL string argument
+func c_null(args ...*C.char) bool {
+  for _, arg := range args {
+    if arg == nil {
+      fail(STATUS_BAD_ARG, errors.New("required argument is NULL"))
+      return true
+    }
+  }
+  return false
+}
+
+// c_null_out reports (and records) a NULL out-parameter
+func c_null_out(args ...*C.int) bool {
+  for _, arg := range args {
+    if arg == nil {
+      fail(STATUS_BAD_ARG, errors.New("out-parameter is NULL"))
+      return true
+    }
+  }
+  return false
+}
+
+// c_set stores value in an out-parameter unless it is NULL
+func c_set(ptr *C.int, value int) {
+  if ptr != nil {
+    *ptr = C.int(value)
+  }
+}
+
+// c_data copies data_len bytes, NULL is accepted only with data_len 0
+func c_data(data *C.char, data_len C.int) ([]byte, bool) {
+  if data_len < 0 || (data == nil && data_len > 0) {
+    fail(STATUS_BAD_ARG, errors.New("invalid data pointer or length"))
+    return nil, false
+  }
+  if data_len == 0 {
+    return []byte{}, true
+  }
+  return C.GoBytes(unsafe.Pointer(data), data_len), true
+}
+
+// c_buffer views caller owned C memory as a byte slice
+func c_buffer(ptr unsafe.Pointer, size int) []byte {
+  return (*[1 << 30]byte)(ptr)[:size:size]
+}
+
+// c_bytes copies data into C memory, never returning NULL for empty data
+func c_bytes(data []byte) *C.char {
+  size := len(data)
+  if size == 0 {
+    size = 1
+  }
+  ptr := C.malloc(C.size_t(size))
+  copy(c_buffer(ptr, size), data)
+  return (*C.char)(ptr)
+}
+
+// decrypt returns hex cleartext, caller must free_cstring the result
 //export decrypt
 func decrypt(secret_key *C.char, ciphertext_hex *C.char) *C.char {
-  ciphertext, err := hex.DecodeString(C.GoString(ciphertext_hex))
-  if err != nil {
+  clear_error()
+  defer audit_begin("decrypt", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
     return C.CString("")
   }
-  data, err := madmin.DecryptData(C.GoString(secret_key), bytes.NewReader(ciphertext))
+  key := c_secret(secret_key)
+  defer wipe(key)
+  input, output := get_buffer(), get_buffer()
+  defer put_buffer(input)
+  defer put_buffer(output)
+  ciphertext, err := decode_hex_to(input, c_view(ciphertext_hex))
   if err != nil {
     return C.CString("")
   }
+  if status := decrypt_to(output, key, ciphertext, nil); status != STATUS_OK {
+    return C.CString("")
+  }
+  return c_hex(output.Bytes())
+}
+
+// decrypt_wipe is decrypt_ex that also zeroes the caller's secret_key buffer
+// when wipe_key is non-zero. The buffer must be writable memory owned by the
+// caller (e.g. ctypes.create_string_buffer), never an immutable string.
+// Caller must free_cstring the result
+//export decrypt_wipe
+func decrypt_wipe(secret_key *C.char, ciphertext_hex *C.char, wipe_key C.int, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_wipe", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  if wipe_key != 0 {
+    c_wipe(secret_key)
+  }
+  data, code := decrypt_data(key, C.GoString(ciphertext_hex))
+  *status = C.int(code)
   return C.CString(hex.EncodeToString(data))
 }
 
+// encrypt returns hex ciphertext, caller must free_cstring the result
 //export encrypt
 func encrypt(secret_key *C.char, cleartext_hex *C.char) *C.char {
-  cleartext, err := hex.DecodeString(C.GoString(cleartext_hex))
+  clear_error()
+  defer audit_begin("encrypt", secret_key, c_hex_size(cleartext_hex)).end()
+  return encrypt_cased(secret_key, cleartext_hex, false)
+}
+
+// encrypt_hex_case is encrypt returning uppercase hex if uppercase is
+// non-zero. Cleartext hex of either case is accepted.
+// Caller must free_cstring the result
+//export encrypt_hex_case
+func encrypt_hex_case(secret_key *C.char, cleartext_hex *C.char, uppercase C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_hex_case", secret_key, c_hex_size(cleartext_hex)).end()
+  return encrypt_cased(secret_key, cleartext_hex, uppercase != 0)
+}
+
+func encrypt_cased(secret_key *C.char, cleartext_hex *C.char, uppercase bool) *C.char {
+  if c_no_key(secret_key) || c_null(cleartext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  input, output := get_buffer(), get_buffer()
+  defer put_buffer(input)
+  defer put_buffer(output)
+  cleartext, err := decode_hex_to(input, c_view(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  if status := encrypt_to(output, key, cleartext, default_aead(), nil); status != STATUS_OK {
+    return C.CString("")
+  }
+  return c_hex_case(output.Bytes(), uppercase)
+}
+
+// decrypt_split_to is decrypt_to refining authentication failures with
+// split_auth_status, both under the one key derivation
+func decrypt_split_to(buffer *bytes.Buffer, secret_key []byte, ciphertext []byte) int {
+  aead, status := ciphertext_aead(secret_key, ciphertext)
+  if status == STATUS_OK && aead != nil {
+    status = decrypt_aead_to(buffer, aead, ciphertext, nil)
+  }
+  return split_auth_status(aead, ciphertext, status, buffer.Len())
+}
+
+// split_auth_status refines the status of a decryption that yielded
+// decrypted bytes into STATUS_TRUNCATED, STATUS_CORRUPT or STATUS_WRONG_KEY
+// as described at the STATUS_* table, and records the refined one. aead is
+// the one ciphertext was decrypted under, nil if it has no valid header
+func split_auth_status(aead cipher.AEAD, ciphertext []byte, status int, decrypted int) int {
+  if status == STATUS_MALFORMED || status == STATUS_AUTH_FAILED {
+    if truncated_status(aead, ciphertext, decrypted) == STATUS_TRUNCATED {
+      return fail_as(STATUS_TRUNCATED)
+    }
+  }
+  switch {
+  case status == STATUS_AUTH_FAILED && (decrypted > 0 || opens_package(aead, ciphertext, 1)):
+    return fail_as(STATUS_CORRUPT)
+  case status == STATUS_AUTH_FAILED:
+    return fail_as(STATUS_WRONG_KEY)
+  }
+  return status
+}
+
+// decrypt_ex is decrypt with a status out-parameter, see STATUS_* above.
+// Authentication failures are reported as STATUS_WRONG_KEY, STATUS_CORRUPT
+// or STATUS_TRUNCATED instead of STATUS_AUTH_FAILED, a header cut short
+// as STATUS_TRUNCATED instead of STATUS_MALFORMED.
+// Caller must free_cstring the result
+//export decrypt_ex
+func decrypt_ex(secret_key *C.char, ciphertext_hex *C.char, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_ex", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  input, output := get_buffer(), get_buffer()
+  defer put_buffer(input)
+  defer put_buffer(output)
+  ciphertext, err := decode_hex_to(input, c_view(ciphertext_hex))
+  if err != nil {
+    *status = STATUS_BAD_HEX
+    return C.CString("")
+  }
+  code := decrypt_split_to(output, key, ciphertext)
+  *status = C.int(code)
+  if code != STATUS_OK {
+    return C.CString("")
+  }
+  return c_hex(output.Bytes())
+}
+
+// encrypt_ex is encrypt with a status out-parameter, see STATUS_* above,
+// caller must free_cstring the result
+//export encrypt_ex
+func encrypt_ex(secret_key *C.char, cleartext_hex *C.char, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_ex", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, code := encrypt_data(key, C.GoString(cleartext_hex))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// encrypt_aad is encrypt_ex binding associated data (e.g. object name or
+// tenant id) to the ciphertext. It is not stored, decrypt_aad must be given
+// the same aad. Empty aad is equivalent to encrypt_ex.
+// Caller must free_cstring the result
+//export encrypt_aad
+func encrypt_aad(secret_key *C.char, cleartext_hex *C.char, aad *C.char, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_aad", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    *status = STATUS_BAD_HEX
+    return C.CString("")
+  }
+  data, code := encrypt_aead(key, cleartext, default_aead(), []byte(C.GoString(aad)))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_aad reverses encrypt_aad, reporting STATUS_AUTH_FAILED if aad
+// does not match. Empty aad is equivalent to decrypt_ex.
+// Caller must free_cstring the result
+//export decrypt_aad
+func decrypt_aad(secret_key *C.char, ciphertext_hex *C.char, aad *C.char, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_aad", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    *status = STATUS_BAD_HEX
+    return C.CString("")
+  }
+  data, code := decrypt_aead(key, ciphertext, []byte(C.GoString(aad)))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// rekey re-encrypts ciphertext under new_key without exposing the cleartext,
+// caller must free_cstring the result
+//export rekey
+func rekey(old_key *C.char, new_key *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("rekey", new_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(old_key) || c_no_key(new_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  old_secret := c_secret(old_key)
+  defer wipe(old_secret)
+  new_secret := c_secret(new_key)
+  defer wipe(new_secret)
+  data, status := rekey_data(old_secret, new_secret, C.GoString(ciphertext_hex))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// rekey_verified is rekey returning the new ciphertext only once it
+// decrypts back to the original cleartext under new_key. Returns empty
+// string on failure, a failed verification is recorded for last_error as
+// STATUS_INTERNAL. Caller must free_cstring the result
+//export rekey_verified
+func rekey_verified(old_key *C.char, new_key *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("rekey_verified", new_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(old_key) || c_no_key(new_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  old_secret := c_secret(old_key)
+  defer wipe(old_secret)
+  new_secret := c_secret(new_key)
+  defer wipe(new_secret)
+  data, status := rekey_verified_data(old_secret, new_secret, C.GoString(ciphertext_hex))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// rekey_ex is rekey with a status out-parameter, see STATUS_* above,
+// caller must free_cstring the result
+//export rekey_ex
+func rekey_ex(old_key *C.char, new_key *C.char, ciphertext_hex *C.char, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("rekey_ex", new_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(old_key) || c_no_key(new_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  old_secret := c_secret(old_key)
+  defer wipe(old_secret)
+  new_secret := c_secret(new_key)
+  defer wipe(new_secret)
+  data, code := rekey_data(old_secret, new_secret, C.GoString(ciphertext_hex))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// verify authenticates the whole ciphertext without keeping the cleartext.
+// Returns STATUS_OK, STATUS_AUTH_FAILED for wrong key or modified data,
+// STATUS_BAD_HEX or STATUS_MALFORMED for input that is not a ciphertext
+//export verify
+func verify(secret_key *C.char, ciphertext_hex *C.char) C.int {
+  clear_error()
+  defer audit_begin("verify", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
   if err != nil {
+    return STATUS_BAD_HEX
+  }
+  if empty_ciphertext(ciphertext) {
+    return STATUS_OK
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return C.int(status)
+  }
+  reader, status := decrypt_reader(key, bytes.NewReader(ciphertext), nil)
+  if status != STATUS_OK {
+    return C.int(status)
+  }
+  if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+    return C.int(stream_status(err))
+  }
+  return STATUS_OK
+}
+
+// is_hex tells whether data holds hex digits only, without decoding it
+func is_hex(data []byte) bool {
+  for _, char := range data {
+    if !('0' <= char && char <= '9' || 'a' <= char && char <= 'f' || 'A' <= char && char <= 'F') {
+      return false
+    }
+  }
+  return true
+}
+
+// can_decrypt_data decodes and authenticates only the header and first
+// package of the hex ciphertext, the total length tells whether that
+// package has to be the final one. The hex of the rest is only validated
+func can_decrypt_data(secret_key []byte, ciphertext_hex []byte) int {
+  ciphertext_hex = bytes.TrimSpace(ciphertext_hex)
+  size := len(ciphertext_hex) / 2
+  end := size
+  if end > header_size + package_size {
+    end = header_size + package_size
+  }
+  head := make([]byte, end)
+  if _, err := hex.Decode(head, ciphertext_hex[:2 * end]); err != nil || len(ciphertext_hex) % 2 != 0 || !is_hex(ciphertext_hex[2 * end:]) {
+    return fail(STATUS_BAD_HEX, errors.New("invalid hex ciphertext"))
+  }
+  if empty_ciphertext(head) {
+    return STATUS_OK
+  }
+  if status := check_header(head); status != STATUS_OK {
+    return status
+  }
+  if end - header_size < package_overhead {
+    return fail(STATUS_MALFORMED, errors.New("first package shorter than a tag"))
+  }
+  aead, err := new_aead(secret_key, head[:32], head[32])
+  if err != nil {
+    return fail(STATUS_INTERNAL, err)
+  }
+  opener := new_package_opener(aead, head[33:header_size])
+  cleartext, err := opener.open(nil, head[header_size:], 0, size == end)
+  wipe(cleartext)
+  if err != nil {
+    return fail(STATUS_AUTH_FAILED, err)
+  }
+  return STATUS_OK
+}
+
+// can_decrypt checks secret_key against the first package only, which is
+// much cheaper than verify for large ciphertexts but says nothing about
+// the packages after it. Returns 1 if the key is right, 0 if the package
+// is not authentic (wrong key or modified data) and -STATUS_* for input
+// that is not a ciphertext. Empty input decrypts under any key, it gives 1
+//export can_decrypt
+func can_decrypt(secret_key *C.char, ciphertext_hex *C.char) C.int {
+  clear_error()
+  defer audit_begin("can_decrypt", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return -STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  switch status := can_decrypt_data(key, c_view(ciphertext_hex)); status {
+  case STATUS_OK:
+    return 1
+  case STATUS_AUTH_FAILED:
+    return 0
+  default:
+    return C.int(-status)
+  }
+}
+
+// decrypt_base64 is decrypt with standard base64 instead of hex,
+// caller must free_cstring the result
+//export decrypt_base64
+func decrypt_base64(secret_key *C.char, ciphertext_base64 *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_base64", secret_key, c_base64_size(ciphertext_base64)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_base64) {
     return C.CString("")
   }
-  data, err := madmin.EncryptData(C.GoString(secret_key), cleartext)
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_base64(C.GoString(ciphertext_base64))
   if err != nil {
     return C.CString("")
   }
+  data, status := decrypt_raw(key, ciphertext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(base64.StdEncoding.EncodeToString(data))
+}
+
+// encrypt_base64 is encrypt with standard base64 instead of hex,
+// caller must free_cstring the result
+//export encrypt_base64
+func encrypt_base64(secret_key *C.char, cleartext_base64 *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_base64", secret_key, c_base64_size(cleartext_base64)).end()
+  if c_no_key(secret_key) || c_null(cleartext_base64) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_base64(C.GoString(cleartext_base64))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := encrypt_raw(key, cleartext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(base64.StdEncoding.EncodeToString(data))
+}
+
+// encrypt_text encrypts the UTF-8 (or any) bytes of text up to its NUL
+// and returns hex ciphertext, sparing callers the hex encoding of short
+// tokens. Caller must free_cstring the result
+//export encrypt_text
+func encrypt_text(secret_key *C.char, text *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_text", secret_key, c_text_size(text)).end()
+  if c_no_key(secret_key) || c_null(text) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := encrypt_raw(key, []byte(C.GoString(text)))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
   return C.CString(hex.EncodeToString(data))
 }
 
+// decrypt_text reverses encrypt_text and returns the cleartext as a NUL
+// terminated string. A cleartext containing NUL bytes comes back cut at
+// the first one, use decrypt_bytes for binary data.
+// Caller must free_cstring the result
+//export decrypt_text
+func decrypt_text(secret_key *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_text", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := decrypt_data(key, C.GoString(ciphertext_hex))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(string(data))
+}
+
+// encrypt_bytes encrypts data_len raw bytes and stores the ciphertext
+// length in out_len. On failure returns NULL and stores -STATUS_* in out_len.
+// Caller must free_cstring the result
+//export encrypt_bytes
+func encrypt_bytes(secret_key *C.char, data *C.char, data_len C.int, out_len *C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_bytes", secret_key, c_data_size(data_len)).end()
+  if c_no_key(secret_key) || c_null_out(out_len) {
+    c_set(out_len, -STATUS_BAD_ARG)
+    return nil
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  input, ok := c_data(data, data_len)
+  if !ok {
+    *out_len = -STATUS_BAD_ARG
+    return nil
+  }
+  result, status := encrypt_raw(key, input)
+  if status != STATUS_OK {
+    *out_len = C.int(-status)
+    return nil
+  }
+  *out_len = C.int(len(result))
+  return c_bytes(result)
+}
+
+// decrypt_bytes is the raw byte counterpart of decrypt, see encrypt_bytes
+//export decrypt_bytes
+func decrypt_bytes(secret_key *C.char, data *C.char, data_len C.int, out_len *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_bytes", secret_key, c_data_size(data_len)).end()
+  if c_no_key(secret_key) || c_null_out(out_len) {
+    c_set(out_len, -STATUS_BAD_ARG)
+    return nil
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  input, ok := c_data(data, data_len)
+  if !ok {
+    *out_len = -STATUS_BAD_ARG
+    return nil
+  }
+  result, status := decrypt_raw(key, input)
+  if status != STATUS_OK {
+    *out_len = C.int(-status)
+    return nil
+  }
+  *out_len = C.int(len(result))
+  return c_bytes(result)
+}
+
+// free_cstring releases a string returned by any of the exports
+//export free_cstring
+func free_cstring(ptr *C.char) {
+  C.free(unsafe.Pointer(ptr))
+}
+
+// secure_free is free_cstring zeroing the first length bytes before, or
+// up to the terminating NUL if length is negative. Callers handling
+// cleartext or keys should prefer it, so that nothing lingers in freed
+// heap memory: length is out_len for raw byte results, -1 for strings
+//export secure_free
+func secure_free(ptr *C.char, length C.int) {
+  if ptr == nil {
+    return
+  }
+  secure_wipe(ptr, length)
+  C.free(unsafe.Pointer(ptr))
+}
+
+// secure_wipe is the zeroing step of secure_free, on its own so that it
+// can be checked on memory that is still allocated
+func secure_wipe(ptr *C.char, length C.int) {
+  if length < 0 {
+    c_wipe(ptr)
+  } else {
+    C.memset(unsafe.Pointer(ptr), 0, C.size_t(length))
+  }
+}
+
 func main() {}
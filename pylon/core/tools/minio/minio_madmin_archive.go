@@ -0,0 +1,257 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+)
+
+// Objects in an archive are not length prefixed and the chunk size is not
+// recorded, so boundaries are found by authentication. The chunk size of
+// an object is the first size its first package opens with as a non-final
+// package, trying archive_chunk_sizes before any other. Its final package
+// (or only package, then up to max_chunk_size) is searched for by length,
+// trying only lengths that end the archive or are followed by a valid AEAD
+// ID where the next header would have it. Each object gets
+// archive_search_budget bytes of packages opened, which bounds the time
+// spent on a wrong key, but also limits single package objects to about
+// 128 KiB and other chunk sizes to about 10 KiB
+var archive_chunk_sizes = archive_chunk_candidates()
+
+const (
+  archive_search_budget = 64 << 20
+  // Offsets tried as the start of the next object once an object could
+  // not be decrypted, each costs a key derivation
+  archive_resync_limit = 32
+)
+
+// archive_chunk_candidates is the default chunk size followed by the powers
+// of two from min_chunk_size to max_chunk_size
+func archive_chunk_candidates() []int {
+  sizes := []int{package_payload}
+  for size := min_chunk_size; size <= max_chunk_size; size *= 2 {
+    if size != package_payload {
+      sizes = append(sizes, size)
+    }
+  }
+  return sizes
+}
+
+// archive_search opens the packages of one object, failing every open
+// once budget bytes were opened
+type archive_search struct {
+  opener *package_opener
+  budget int
+}
+
+func (search *archive_search) open(dst []byte, data []byte, idx int, final bool) ([]byte, bool) {
+  if len(data) > search.budget {
+    search.budget = 0
+    return nil, false
+  }
+  search.budget -= len(data)
+  result, err := search.opener.open(dst, data, idx, final)
+  return result, err == nil
+}
+
+// archive_first opens the first package of body as a non-final one of
+// size bytes of cleartext
+func archive_first(search *archive_search, body []byte, size int) ([]byte, bool) {
+  if len(body) <= size + package_overhead {
+    return nil, false
+  }
+  return search.open(nil, body[:size + package_overhead], 0, false)
+}
+
+// archive_final opens the final package at the start of rest, it is at
+// most limit bytes long. Returns its cleartext and length
+func archive_final(search *archive_search, rest []byte, idx int, limit int) ([]byte, int, bool) {
+  // The last object ends with the archive, that length goes first
+  if len(rest) <= limit {
+    if cleartext, ok := search.open(nil, rest, idx, true); ok {
+      return cleartext, len(rest), true
+    }
+  }
+  for size := package_overhead; size <= limit && size + header_size + package_overhead <= len(rest) && search.budget > 0; size++ {
+    if id := rest[size + 32]; id != aead_aes_gcm && id != aead_c20p1305 {
+      continue
+    }
+    if cleartext, ok := search.open(nil, rest[:size], idx, true); ok {
+      return cleartext, size, true
+    }
+  }
+  return nil, 0, false
+}
+
+// archive_object decrypts the object at the start of data and returns its
+// cleartext and ciphertext length. An object with a modified package
+// fails with STATUS_CORRUPT and its full length, provided the package
+// after it authenticates. Otherwise the length of a failed object is how
+// far it is known to reach, the next object starts further on
+func archive_object(secret_key []byte, data []byte) ([]byte, int, int) {
+  if len(data) < header_size + package_overhead {
+    return nil, 0, fail(STATUS_MALFORMED, errors.New("archive ends inside an object header"))
+  }
+  if status := check_header(data); status != STATUS_OK {
+    return nil, 0, status
+  }
+  aead, err := new_aead(secret_key, data[:32], data[32])
+  if err != nil {
+    return nil, 0, fail(STATUS_INTERNAL, err)
+  }
+  search := &archive_search{opener: new_package_opener(aead, data[33:header_size]), budget: archive_search_budget}
+  body := data[header_size:]
+  chunk_size := 0
+  var cleartext []byte
+  for _, size := range archive_chunk_sizes {
+    if result, ok := archive_first(search, body, size); ok {
+      chunk_size, cleartext = size, result
+      break
+    }
+  }
+  if chunk_size == 0 {
+    if result, size, ok := archive_final(search, body, 0, max_chunk_size + package_overhead); ok {
+      return result, header_size + size, STATUS_OK
+    }
+    // Any other chunk size, smallest first. The candidates are the default
+    // and the powers of two
+    for size := min_chunk_size; size <= max_chunk_size && search.budget > 0; size++ {
+      if size == package_payload || size & (size - 1) == 0 {
+        continue
+      }
+      if result, ok := archive_first(search, body, size); ok {
+        chunk_size, cleartext = size, result
+        break
+      }
+    }
+  }
+  if chunk_size == 0 {
+    return nil, 0, fail(STATUS_AUTH_FAILED, errors.New("no authentic package at object start"))
+  }
+  full := chunk_size + package_overhead
+  offset, corrupt, skipped := full, false, false
+  for idx := 1; ; idx++ {
+    rest := body[offset:]
+    if len(rest) > full {
+      if result, ok := search.open(cleartext, rest[:full], idx, false); ok {
+        cleartext, skipped = result, false
+        offset += full
+        continue
+      }
+    }
+    if final, size, ok := archive_final(search, rest, idx, full); ok {
+      cleartext = append(cleartext, final...)
+      wipe(final)
+      if corrupt {
+        wipe(cleartext)
+        return nil, header_size + offset + size, fail(STATUS_CORRUPT, errors.New("object package is not authentic"))
+      }
+      return cleartext, header_size + offset + size, STATUS_OK
+    }
+    // A modified package is skipped, unless the one before was skipped too
+    if skipped || len(rest) <= full {
+      wipe(cleartext)
+      if skipped {
+        offset -= full
+      }
+      return nil, header_size + offset, fail(STATUS_AUTH_FAILED, errors.New("object package is not authentic"))
+    }
+    corrupt, skipped = true, true
+    offset += full
+  }
+}
+
+// archive_resync returns the first offset from start on that could hold
+// an object, going by the AEAD ID, or len(archive) if there is none
+func archive_resync(archive []byte, start int) int {
+  for offset := start; offset + header_size + package_overhead <= len(archive); offset++ {
+    if id := archive[offset + 32]; id == aead_aes_gcm || id == aead_c20p1305 {
+      return offset
+    }
+  }
+  return len(archive)
+}
+
+// decrypt_archive_data returns the hex cleartexts of the objects in order,
+// a bad object gives a null entry. Where a bad object ends is unknown
+// unless only some of its packages were modified, then the next object is
+// searched for at up to archive_resync_limit offsets, past that the rest
+// of the archive is left out
+func decrypt_archive_data(secret_key []byte, archive []byte) []*string {
+  entries := []*string{}
+  // Offsets tried since the last object found, -1 when not searching
+  probes := -1
+  for offset := 0; offset < len(archive); {
+    cleartext, size, status := archive_object(secret_key, archive[offset:])
+    if status == STATUS_OK || status == STATUS_CORRUPT {
+      var entry *string
+      if status == STATUS_OK {
+        text := hex.EncodeToString(cleartext)
+        wipe(cleartext)
+        entry = &text
+      }
+      entries = append(entries, entry)
+      offset, probes = offset + size, -1
+      continue
+    }
+    // A failed object reaching size bytes, or the start of one if any
+    next := offset + 1
+    if probes < 0 || size > 0 {
+      entries = append(entries, nil)
+      next, probes = offset + header_size + package_overhead, 0
+      if size > 0 {
+        next = offset + size
+      }
+    }
+    if probes++; probes > archive_resync_limit {
+      break
+    }
+    offset = archive_resync(archive, next)
+  }
+  return entries
+}
+
+// decrypt_archive decrypts a concatenation of ciphertexts under the same
+// secret key, from encrypt or encrypt_chunked, and returns a JSON array of
+// their hex cleartexts in order. An object that does not decrypt (wrong
+// key, modified, or beyond the search above) is marked as null and the
+// objects after it are still returned. The end of an object can only be
+// found by decrypting it, so after a null the next object is searched for,
+// which costs a key derivation per offset tried: a wrong key for the whole
+// archive takes a few seconds before it gives up. Returns empty string on
+// bad hex. Caller must free_cstring the result
+//export decrypt_archive
+func decrypt_archive(secret_key *C.char, archive_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_archive", secret_key, c_hex_size(archive_hex)).end()
+  if c_no_key(secret_key) || c_null(archive_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  archive, err := decode_hex(C.GoString(archive_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  result, err := json.Marshal(decrypt_archive_data(key, archive))
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
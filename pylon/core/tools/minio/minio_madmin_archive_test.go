@@ -0,0 +1,126 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/hex"
+  "encoding/json"
+  "strings"
+  "testing"
+  "time"
+)
+
+// archive_member encrypts size bytes of fill in chunk_size packages, 0 for
+// the default, and returns the hex cleartext and ciphertext
+func archive_member(t *testing.T, key c_string, fill string, size int, chunk_size int) (string, string) {
+  cleartext := strings.Repeat(fill, size)
+  input := test_cstring(cleartext)
+  defer test_free(input)
+  ciphertext := test_take(encrypt_chunked(key, input, test_int(chunk_size)))
+  if ciphertext == "" {
+    t.Fatalf("encrypt_chunked %d: %s", chunk_size, test_take(last_error()))
+  }
+  return cleartext, ciphertext
+}
+
+func archive_entries(t *testing.T, key c_string, members ...string) []*string {
+  archive := test_cstring(strings.Join(members, ""))
+  defer test_free(archive)
+  var entries []*string
+  if err := json.Unmarshal([]byte(test_take(decrypt_archive(key, archive))), &entries); err != nil {
+    t.Fatal(err)
+  }
+  return entries
+}
+
+func check_entries(t *testing.T, name string, entries []*string, want ...string) {
+  if len(entries) != len(want) {
+    t.Fatalf("%s: %d entries, want %d", name, len(entries), len(want))
+  }
+  for idx, entry := range entries {
+    switch {
+    case want[idx] == "" && entry != nil:
+      t.Errorf("%s: entry %d decrypted, want null", name, idx)
+    case want[idx] != "" && (entry == nil || *entry != want[idx]):
+      t.Errorf("%s: entry %d does not match its cleartext", name, idx)
+    }
+  }
+}
+
+func TestDecryptArchiveMixedChunkSizes(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  var cleartexts, ciphertexts []string
+  for _, member := range []struct {
+    size       int
+    chunk_size int
+  }{
+    {2 * package_payload + 500, 0},
+    {10000, 4096},
+    {3500, 1000},
+    {100, 1 << 16},
+    {2 * package_payload, 0},
+  } {
+    cleartext, ciphertext := archive_member(t, key, "a5", member.size, member.chunk_size)
+    cleartexts, ciphertexts = append(cleartexts, cleartext), append(ciphertexts, ciphertext)
+  }
+  check_entries(t, "mixed chunk sizes", archive_entries(t, key, ciphertexts...), cleartexts...)
+}
+
+func TestDecryptArchiveKeepsObjectsAfterBadOne(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  wrong_key := test_cstring(test_key + "!")
+  defer test_free(wrong_key)
+  first, first_ct := archive_member(t, key, "01", 3000, 0)
+  _, foreign_ct := archive_member(t, wrong_key, "02", 2000, 0)
+  last, last_ct := archive_member(t, key, "03", package_payload + 10, 0)
+  check_entries(t, "wrong key in the middle", archive_entries(t, key, first_ct, foreign_ct, last_ct), first, "", last)
+  // Three packages, the middle one modified
+  _, modified_ct := archive_member(t, key, "04", 2 * package_payload + 10, 0)
+  modified, _ := hex.DecodeString(modified_ct)
+  modified[header_size + package_size + 100] ^= 0x01
+  modified_ct = hex.EncodeToString(modified)
+  check_entries(t, "modified package in the middle", archive_entries(t, key, first_ct, modified_ct, last_ct), first, "", last)
+  // Two bad objects in a row, both still stand for one entry each
+  check_entries(t, "modified then foreign", archive_entries(t, key, first_ct, modified_ct, foreign_ct, last_ct), first, "", "", last)
+}
+
+func TestDecryptArchiveWrongKeyBounded(t *testing.T) {
+  if testing.Short() {
+    t.Skip("runs up to archive_resync_limit key derivations")
+  }
+  key := test_cstring(test_key)
+  defer test_free(key)
+  wrong_key := test_cstring(test_key + "!")
+  defer test_free(wrong_key)
+  var ciphertexts []string
+  for idx := 0; idx < 4; idx++ {
+    _, ciphertext := archive_member(t, key, "5a", 4 * package_payload, 0)
+    ciphertexts = append(ciphertexts, ciphertext)
+  }
+  start := time.Now()
+  entries := archive_entries(t, wrong_key, ciphertexts...)
+  if elapsed := time.Since(start); elapsed > 30 * time.Second {
+    t.Errorf("wrong key took %v", elapsed)
+  }
+  for idx, entry := range entries {
+    if entry != nil {
+      t.Errorf("entry %d decrypted under the wrong key", idx)
+    }
+  }
+}
@@ -0,0 +1,390 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "unsafe"
+)
+
+// export_case calls an export with a secret key (ignored if keyless) and
+// one input argument, and gives its result as a string. Decrypting exports
+// must return empty for empty input, given as empty
+type export_case struct {
+  name     string
+  keyless  bool
+  decrypts bool
+  empty    string
+  call     func(key c_string, input c_string) string
+}
+
+func status_of(ptr *c_int) string {
+  return fmt.Sprintf("status %d", test_int_of(ptr))
+}
+
+func export_cases(t *testing.T) []export_case {
+  dir, err := ioutil.TempDir("", "pylon-args")
+  if err != nil {
+    t.Fatal(err)
+  }
+  key_path := filepath.Join(dir, "key")
+  if err := ioutil.WriteFile(key_path, []byte(test_key + "\n"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    devnull.Close()
+    os.RemoveAll(dir)
+  })
+  path := func(name string) string {
+    return filepath.Join(dir, name)
+  }
+  status, out_len, crc_ok := test_new_int(), test_new_int(), test_new_int()
+  buffer := make([]byte, 64)
+  raw_key := test_cstring("0000000000000000000000000000000000000000000000000000000000000000")
+  t.Cleanup(func() { test_free(raw_key) })
+  records := test_cstring("[]")
+  t.Cleanup(func() { test_free(records) })
+  return []export_case{
+    {"decrypt", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt(key, input))
+    }},
+    {"decrypt_wipe", false, true, "status 0", func(key, input c_string) string {
+      return test_take(decrypt_wipe(key, input, 0, status)) + status_of(status)
+    }},
+    {"decrypt_ex", false, true, "status 0", func(key, input c_string) string {
+      return test_take(decrypt_ex(key, input, status)) + status_of(status)
+    }},
+    {"decrypt_aad", false, true, "status 0", func(key, input c_string) string {
+      return test_take(decrypt_aad(key, input, nil, status)) + status_of(status)
+    }},
+    {"decrypt_base64", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_base64(key, input))
+    }},
+    {"decrypt_text", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_text(key, input))
+    }},
+    {"decrypt_bytes", false, true, "status 0", func(key, input c_string) string {
+      size := len(test_gostring(input))
+      if input == nil {
+        size = 4
+      }
+      result := decrypt_bytes(key, input, test_int(size), out_len)
+      return string(test_take_bytes(result, out_len)) + fmt.Sprintf("status %d", -test_int_of(out_len))
+    }},
+    {"decrypt_result", false, true, "status 0", func(key, input c_string) string {
+      result := decrypt_result(key, input)
+      defer result_free(result)
+      return fmt.Sprintf("status %d", result.status)
+    }},
+    {"verify", false, true, "status 0", func(key, input c_string) string {
+      return fmt.Sprintf("status %d", verify(key, input))
+    }},
+    {"can_decrypt", false, true, "1", func(key, input c_string) string {
+      return fmt.Sprint(can_decrypt(key, input))
+    }},
+    {"decrypt_into", false, true, "0", func(key, input c_string) string {
+      return fmt.Sprint(decrypt_into(key, input, (c_string)(unsafe.Pointer(&buffer[0])), test_int(len(buffer))))
+    }},
+    {"decrypt_to_addr", false, true, "0", func(key, input c_string) string {
+      return fmt.Sprint(decrypt_to_addr(key, input, unsafe.Pointer(&buffer[0]), 64))
+    }},
+    {"decrypt_capped", false, true, "status 0", func(key, input c_string) string {
+      return string(test_take_bytes(decrypt_capped(key, input, 64, out_len), out_len)) + fmt.Sprintf("status %d", -test_int_of(out_len))
+    }},
+    {"decrypt_chunked", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_chunked(key, input, 0))
+    }},
+    {"decrypt_range", false, true, "status 0", func(key, input c_string) string {
+      return string(test_take_bytes(decrypt_range(key, input, 0, 0, out_len), out_len)) + fmt.Sprintf("status %d", -test_int_of(out_len))
+    }},
+    {"decrypt_compressed", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_compressed(key, input))
+    }},
+    {"decrypt_with_crc", false, true, "status 0 crc 1", func(key, input c_string) string {
+      return test_take(decrypt_with_crc(key, input, 1, status, crc_ok)) + status_of(status) + fmt.Sprintf(" crc %d", test_int_of(crc_ok))
+    }},
+    {"decrypt_hardened", false, true, "status 0", func(key, input c_string) string {
+      return test_take(decrypt_hardened(key, input, status)) + status_of(status)
+    }},
+    {"decrypt_tagcheck", false, true, "status 0", func(key, input c_string) string {
+      return test_take(decrypt_tagcheck(key, input, 0, status)) + status_of(status)
+    }},
+    {"decrypt_kdf", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_kdf(key, input, KDF_AUTO))
+    }},
+    {"decrypt_auto", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_auto(key, input))
+    }},
+    {"decrypt_opts", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_opts(key, input, nil))
+    }},
+    {"decrypt_with_keyid", false, true, "", func(key, input c_string) string {
+      return test_take(decrypt_with_keyid(key, input))
+    }},
+    {"decrypt_rawkey", true, true, "", func(key, input c_string) string {
+      return test_take(decrypt_rawkey(raw_key, input))
+    }},
+    {"decrypt_best_effort", false, true, "status 0", func(key, input c_string) string {
+      return string(test_take_bytes(decrypt_best_effort(key, input, out_len, status), out_len)) + status_of(status)
+    }},
+    {"decrypt_archive", false, true, "[]", func(key, input c_string) string {
+      return test_take(decrypt_archive(key, input))
+    }},
+    {"decrypt_to_fd", false, true, "0", func(key, input c_string) string {
+      return fmt.Sprint(decrypt_to_fd(key, input, test_int(int(devnull.Fd()))))
+    }},
+    {"decrypt_keyfile", true, true, "status 0", func(key, input c_string) string {
+      key_file := test_cstring(key_path)
+      defer test_free(key_file)
+      return test_take(decrypt_keyfile(key_file, input, status)) + status_of(status)
+    }},
+    {"decrypt_file", false, true, "status 0", func(key, input c_string) string {
+      if input == nil {
+        return fmt.Sprintf("status %d", decrypt_file(key, nil, nil))
+      }
+      in, out := test_cstring(path("in")), test_cstring(path("out"))
+      defer test_free(in)
+      defer test_free(out)
+      ioutil.WriteFile(path("in"), []byte(test_gostring(input)), 0600)
+      return fmt.Sprintf("status %d", decrypt_file(key, in, out))
+    }},
+    {"decrypt_stream", false, true, "status 0", func(key, input c_string) string {
+      handle := decrypt_stream_init(key)
+      if handle == 0 {
+        return "handle 0"
+      }
+      t.Cleanup(func() { decrypt_stream_free(handle) })
+      if input == nil {
+        return string(test_take_bytes(decrypt_stream_update(handle, nil, 4, out_len), out_len))
+      }
+      data, size := test_bytes([]byte(test_gostring(input)))
+      defer test_free(data)
+      test_take_bytes(decrypt_stream_update(handle, data, size, out_len), out_len)
+      return string(test_take_bytes(decrypt_stream_final(handle, out_len), out_len)) + fmt.Sprintf("status %d", -test_int_of(out_len))
+    }},
+    {"decrypt_batch", false, false, "", func(key, input c_string) string {
+      return test_take(decrypt_batch(key, input))
+    }},
+    {"encrypt", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt(key, input))
+    }},
+    {"encrypt_ex", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_ex(key, input, status)) + status_of(status)
+    }},
+    {"encrypt_hex_case", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_hex_case(key, input, 1))
+    }},
+    {"encrypt_aad", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_aad(key, input, nil, status)) + status_of(status)
+    }},
+    {"encrypt_base64", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_base64(key, input))
+    }},
+    {"encrypt_text", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_text(key, input))
+    }},
+    {"encrypt_result", false, false, "", func(key, input c_string) string {
+      result := encrypt_result(key, input)
+      defer result_free(result)
+      return fmt.Sprintf("status %d", result.status)
+    }},
+    {"encrypt_with_cipher", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_with_cipher(key, input, 0, status)) + status_of(status)
+    }},
+    {"encrypt_compressed", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_compressed(key, input))
+    }},
+    {"encrypt_with_crc", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_with_crc(key, input, 1, status)) + status_of(status)
+    }},
+    {"encrypt_chunked", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_chunked(key, input, 0))
+    }},
+    {"encrypt_parallel", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_parallel(key, input, 0))
+    }},
+    {"encrypt_with_hash", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_with_hash(key, input, (c_string)(unsafe.Pointer(&buffer[0])), test_int(len(buffer))))
+    }},
+    {"encrypt_opts", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_opts(key, input, nil))
+    }},
+    {"encrypt_with_keyid", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_with_keyid(key, input, key))
+    }},
+    {"encrypt_rawkey", true, false, "", func(key, input c_string) string {
+      return test_take(encrypt_rawkey(raw_key, input))
+    }},
+    {"encrypt_keyfile", true, false, "", func(key, input c_string) string {
+      key_file := test_cstring(key_path)
+      defer test_free(key_file)
+      return test_take(encrypt_keyfile(key_file, input, status)) + status_of(status)
+    }},
+    {"encrypt_batch", false, false, "", func(key, input c_string) string {
+      return test_take(encrypt_batch(key, input))
+    }},
+    {"rekey", false, false, "", func(key, input c_string) string {
+      return test_take(rekey(key, key, input))
+    }},
+    {"rekey_verified", false, false, "", func(key, input c_string) string {
+      return test_take(rekey_verified(key, key, input))
+    }},
+    {"rekey_ex", false, false, "", func(key, input c_string) string {
+      return test_take(rekey_ex(key, key, input, status)) + status_of(status)
+    }},
+    {"upgrade_format", false, false, "", func(key, input c_string) string {
+      return test_take(upgrade_format(key, input, 0, status)) + status_of(status)
+    }},
+    {"wrap_key", false, false, "", func(key, input c_string) string {
+      return test_take(wrap_key(key, input))
+    }},
+    {"unwrap_key", false, false, "", func(key, input c_string) string {
+      return test_take(unwrap_key(key, input))
+    }},
+    {"hmac_sha256", false, false, "", func(key, input c_string) string {
+      return test_take(hmac_sha256(key, input))
+    }},
+    {"hmac_verify", false, false, "", func(key, input c_string) string {
+      return fmt.Sprint(hmac_verify(key, input, input))
+    }},
+    {"chain_verify", false, false, "", func(key, input c_string) string {
+      return fmt.Sprint(chain_verify(key, input))
+    }},
+    {"chain_append", false, false, "", func(key, input c_string) string {
+      handle := chain_init(key)
+      if handle == 0 {
+        return "handle 0"
+      }
+      t.Cleanup(func() { chain_free(handle) })
+      return test_take(chain_append(handle, input))
+    }},
+    {"decrypt_size", true, false, "", func(key, input c_string) string {
+      return fmt.Sprint(decrypt_size(input, 0))
+    }},
+    {"inspect", true, false, "", func(key, input c_string) string {
+      return test_take(inspect(input))
+    }},
+    {"detect_cipher", true, false, "", func(key, input c_string) string {
+      return fmt.Sprint(detect_cipher(input))
+    }},
+    {"read_keyid", true, false, "", func(key, input c_string) string {
+      return test_take(read_keyid(input))
+    }},
+    {"split_packages", true, false, "", func(key, input c_string) string {
+      return test_take(split_packages(input))
+    }},
+    {"join_packages", true, false, "", func(key, input c_string) string {
+      return test_take(join_packages(input))
+    }},
+    {"crc32_hex", true, false, "", func(key, input c_string) string {
+      return test_take(crc32_hex(input))
+    }},
+    {"secret_equal", true, false, "", func(key, input c_string) string {
+      return fmt.Sprint(secret_equal(input, input))
+    }},
+    {"check_password_strength", true, false, "", func(key, input c_string) string {
+      return fmt.Sprint(check_password_strength(input))
+    }},
+    {"key_fingerprint", false, false, "", func(key, input c_string) string {
+      return test_take(key_fingerprint(key))
+    }},
+    {"derive_key", false, false, "", func(key, input c_string) string {
+      return test_take(derive_key(key, input, 32))
+    }},
+    {"encrypt_file", false, false, "", func(key, input c_string) string {
+      return fmt.Sprint(encrypt_file(key, input, input))
+    }},
+    {"rekey_file", false, false, "", func(key, input c_string) string {
+      return fmt.Sprint(rekey_file(key, key, input))
+    }},
+    {"encrypt_file_start", false, false, "", func(key, input c_string) string {
+      handle := encrypt_file_start(key, input, input, 0)
+      if handle == 0 {
+        return "handle 0"
+      }
+      return fmt.Sprint(encrypt_file_wait(handle))
+    }},
+    {"encrypt_stream", false, false, "", func(key, input c_string) string {
+      handle := encrypt_stream_init(key)
+      if handle == 0 {
+        return "handle 0"
+      }
+      t.Cleanup(func() { encrypt_stream_free(handle) })
+      data, size := test_bytes([]byte(test_gostring(input)))
+      if input == nil {
+        data, size = nil, 4
+      } else {
+        defer test_free(data)
+      }
+      return string(test_take_bytes(encrypt_stream_update(handle, data, size, out_len), out_len))
+    }},
+  }
+}
+
+// Every export fails with a recorded error instead of crashing when given
+// NULL for the secret key or its input, or an empty secret key
+func TestExportsRejectNullArguments(t *testing.T) {
+  valid := test_cstring("00")
+  defer test_free(valid)
+  empty_key := test_cstring("")
+  defer test_free(empty_key)
+  key := test_cstring(test_key)
+  defer test_free(key)
+  for _, test := range export_cases(t) {
+    if !test.keyless {
+      for name, bad_key := range map[string]c_string{"NULL": nil, "empty": empty_key} {
+        test.call(bad_key, valid)
+        if test_take(last_error()) == "" {
+          t.Errorf("%s: no error recorded for %s key", test.name, name)
+        }
+      }
+    }
+    // key_fingerprint takes no input and derive_key picks a random salt
+    if test.name == "key_fingerprint" || test.name == "derive_key" {
+      continue
+    }
+    test.call(key, nil)
+    if test_take(last_error()) == "" {
+      t.Errorf("%s: no error recorded for NULL input", test.name)
+    }
+  }
+}
+
+// Every decrypting export takes empty input as empty ciphertext
+func TestExportsDecryptEmptyInput(t *testing.T) {
+  empty := test_cstring("")
+  defer test_free(empty)
+  key := test_cstring(test_key)
+  defer test_free(key)
+  for _, test := range export_cases(t) {
+    if !test.decrypts {
+      continue
+    }
+    result := test.call(key, empty)
+    if message := test_take(last_error()); message != "" || result != test.empty {
+      t.Errorf("%s: empty input gave %q (error %q), want %q", test.name, result, message, test.empty)
+    }
+  }
+}
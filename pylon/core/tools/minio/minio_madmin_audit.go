@@ -0,0 +1,190 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "encoding/json"
+  "os"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// Audit records describe an operation by its outcome, payload size and the
+// key_fingerprint of the key used, they never carry key material,
+// cleartext or ciphertext. Every export computing with a secret key, to
+// encrypt, decrypt, authenticate or derive, logs one record per call under
+// its own name, see audit_call. Exports only inspecting a key, such as
+// key_fingerprint, are not logged. The log keeps the most recent
+// max_audit_records, older records are dropped unless drained
+
+const max_audit_records = 1024
+
+type audit_record struct {
+  Time      string `json:"time"`
+  Operation string `json:"operation"`
+  Key       string `json:"key"`
+  Status    int    `json:"status"`
+  Size      int64  `json:"size"`
+}
+
+var (
+  audit_lock    sync.Mutex
+  audit_records = make([]audit_record, max_audit_records)
+  audit_next    int
+  audit_count   int
+)
+
+// audit appends a record to the ring buffer, overwriting the oldest one
+// when full, and updates the metrics counters
+func audit(operation string, key string, status int, size int64) {
+  count_operation(operation, status, size)
+  record := audit_record{
+    Time:      time.Now().UTC().Format(time.RFC3339Nano),
+    Operation: operation,
+    Key:       key,
+    Status:    status,
+    Size:      size,
+  }
+  audit_lock.Lock()
+  defer audit_lock.Unlock()
+  audit_records[audit_next] = record
+  audit_next = (audit_next + 1) % max_audit_records
+  if audit_count < max_audit_records {
+    audit_count++
+  }
+}
+
+// audit_call is one audited export call. Every export computing with a
+// secret key starts one right after clear_error, with the size of the
+// payload the caller passed in (cleartext to encrypt, ciphertext to
+// decrypt), and ends it on return:
+//
+//   defer audit_begin("decrypt", secret_key, c_hex_size(ciphertext_hex)).end()
+//
+// so argument checks, bad input and crypto failures are all logged, with
+// the status recorded by fail. The fingerprint is taken at the start, the
+// key may be wiped by the time the call returns
+type audit_call struct {
+  operation string
+  key       string
+  size      int64
+}
+
+func audit_begin(operation string, secret_key *C.char, size int64) *audit_call {
+  call := &audit_call{operation: operation, size: size}
+  if secret_key != nil {
+    call.key = fingerprint(c_view(secret_key))
+  }
+  return call
+}
+
+// end logs the call with the status the current thread failed with
+func (call *audit_call) end() {
+  call.record(thread_status())
+}
+
+// record logs the call with status, for calls ending on another thread
+// or with a status kept since an earlier call
+func (call *audit_call) record(status int) {
+  audit(call.operation, call.key, status, call.size)
+}
+
+// c_hex_size is the number of bytes hex input stands for
+func c_hex_size(ptr *C.char) int64 {
+  if ptr == nil {
+    return 0
+  }
+  return int64(len(bytes.TrimSpace(c_view(ptr))) / 2)
+}
+
+// c_base64_size is the number of bytes base64 input stands for
+func c_base64_size(ptr *C.char) int64 {
+  if ptr == nil {
+    return 0
+  }
+  data := bytes.TrimRight(bytes.TrimSpace(c_view(ptr)), "=")
+  return int64(len(data) * 3 / 4)
+}
+
+// c_text_size is the length of a NUL terminated input
+func c_text_size(ptr *C.char) int64 {
+  if ptr == nil {
+    return 0
+  }
+  return int64(len(c_view(ptr)))
+}
+
+// c_data_size is data_len of raw input, 0 if invalid
+func c_data_size(data_len C.int) int64 {
+  if data_len < 0 {
+    return 0
+  }
+  return int64(data_len)
+}
+
+// c_fd_size is the size of the regular file open as fd, 0 if unknown
+func c_fd_size(fd C.int) int64 {
+  var stat syscall.Stat_t
+  if syscall.Fstat(int(fd), &stat) != nil || stat.Mode & syscall.S_IFMT != syscall.S_IFREG {
+    return 0
+  }
+  return stat.Size
+}
+
+// c_path_size is the size of the file at path, 0 if unknown
+func c_path_size(path *C.char) int64 {
+  if path == nil {
+    return 0
+  }
+  info, err := os.Stat(C.GoString(path))
+  if err != nil {
+    return 0
+  }
+  return info.Size()
+}
+
+// audit_reset drops every record in the log
+func audit_reset() {
+  audit_lock.Lock()
+  defer audit_lock.Unlock()
+  audit_records = make([]audit_record, max_audit_records)
+  audit_next, audit_count = 0, 0
+}
+
+// drain_audit_log returns the audit records accumulated since the previous
+// call as a JSON array, oldest first, and clears the log.
+// Caller must free_cstring the result
+//export drain_audit_log
+func drain_audit_log() *C.char {
+  clear_error()
+  defer count_export()
+  audit_lock.Lock()
+  records := make([]audit_record, 0, audit_count)
+  first := (audit_next - audit_count + max_audit_records) % max_audit_records
+  for idx := 0; idx < audit_count; idx++ {
+    records = append(records, audit_records[(first + idx) % max_audit_records])
+  }
+  audit_count = 0
+  audit_lock.Unlock()
+  result, err := json.Marshal(records)
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("[]")
+  }
+  return C.CString(string(result))
+}
@@ -0,0 +1,270 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/hex"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "unsafe"
+)
+
+const test_raw_key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func drain_records(t *testing.T) []audit_record {
+  var records []audit_record
+  if err := json.Unmarshal([]byte(test_take(drain_audit_log())), &records); err != nil {
+    t.Fatal(err)
+  }
+  return records
+}
+
+// audit_case calls an export once with a key and hex input. garbage is the
+// status "zz" input fails with and size the size logged for input hex
+type audit_case struct {
+  operation string
+  key       string
+  input     string
+  garbage   int
+  size      func(input string) int64
+  call      func(key c_string, input string)
+}
+
+func hex_input_size(input string) int64 {
+  return int64(len(input) / 2)
+}
+
+func TestAuditCoversEveryExitOfKeyedExports(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  raw_key := test_cstring(test_raw_key)
+  defer test_free(raw_key)
+  cleartext := strings.Repeat("c0ffee", 100)
+  cleartext_ptr := test_cstring(cleartext)
+  ciphertext := test_take(encrypt(key, cleartext_ptr))
+  raw_ciphertext := test_take(encrypt_rawkey(raw_key, cleartext_ptr))
+  chain := chain_init(key)
+  chain_records := `["` + test_take(chain_append(chain, cleartext_ptr)) + `"]`
+  chain_free(chain)
+  test_free(cleartext_ptr)
+  data, _ := hex.DecodeString(cleartext)
+  tag := test_cstring(hex.EncodeToString(hmac_data([]byte(test_key), data)))
+  defer test_free(tag)
+  dir, err := ioutil.TempDir("", "pylon-audit")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer devnull.Close()
+  out_len, status := test_new_int(), test_new_int()
+  buffer := make([]byte, len(cleartext))
+  hex_call := func(call func(key c_string, input c_string)) func(key c_string, input string) {
+    return func(key c_string, input string) {
+      input_ptr := test_cstring(input)
+      defer test_free(input_ptr)
+      call(key, input_ptr)
+    }
+  }
+  // decrypt_from_fd and the stream take raw bytes, "zz" is no ciphertext
+  raw_size := func(input string) int64 {
+    if data, err := hex.DecodeString(input); err == nil {
+      return int64(len(data))
+    }
+    return int64(len(input))
+  }
+  records_size := func(input string) int64 {
+    if input == "zz" {
+      return 0
+    }
+    return hex_input_size(input[2:len(input) - 2])
+  }
+  raw_bytes := func(input string) []byte {
+    if data, err := hex.DecodeString(input); err == nil {
+      return data
+    }
+    return []byte(input)
+  }
+  cases := []audit_case{
+    {"verify", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      verify(key, input)
+    })},
+    {"can_decrypt", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      can_decrypt(key, input)
+    })},
+    {"decrypt_capped", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_capped(key, input, 1 << 20, out_len))
+    })},
+    {"decrypt_into", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      decrypt_into(key, input, (c_string)(unsafe.Pointer(&buffer[0])), test_int(len(buffer)))
+    })},
+    {"decrypt_to_addr", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      decrypt_to_addr(key, input, unsafe.Pointer(&buffer[0]), 300)
+    })},
+    {"decrypt_to_fd", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      decrypt_to_fd(key, input, test_int(int(devnull.Fd())))
+    })},
+    {"decrypt_from_fd", test_key, ciphertext, STATUS_MALFORMED, raw_size, func(key c_string, input string) {
+      path := filepath.Join(dir, "in")
+      if err := ioutil.WriteFile(path, raw_bytes(input), 0600); err != nil {
+        t.Fatal(err)
+      }
+      in, err := os.Open(path)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer in.Close()
+      decrypt_from_fd(key, test_int(int(in.Fd())), test_int(int(devnull.Fd())))
+    }},
+    {"decrypt_range", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_range(key, input, 1, 2, out_len))
+    })},
+    {"decrypt_chunked", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_chunked(key, input, 0))
+    })},
+    {"encrypt_chunked", test_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(encrypt_chunked(key, input, 1000))
+    })},
+    {"encrypt_parallel", test_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(encrypt_parallel(key, input, 2))
+    })},
+    {"decrypt_kdf", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_kdf(key, input, KDF_ARGON2ID))
+    })},
+    {"decrypt_auto", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_auto(key, input))
+    })},
+    {"encrypt_rawkey", test_raw_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(encrypt_rawkey(key, input))
+    })},
+    {"decrypt_rawkey", test_raw_key, raw_ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_rawkey(key, input))
+    })},
+    {"decrypt_hardened", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_hardened(key, input, status))
+    })},
+    {"decrypt_best_effort", test_key, ciphertext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(decrypt_best_effort(key, input, out_len, status))
+    })},
+    {"encrypt_opts", test_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      options := test_cstring(`{"compress": true}`)
+      defer test_free(options)
+      free_cstring(encrypt_opts(key, input, options))
+    })},
+    {"chain_init", test_key, "", STATUS_OK, func(string) int64 { return 0 }, func(key c_string, input string) {
+      chain_free(chain_init(key))
+    }},
+    // The handle is opened unaudited beforehand, a NULL key leaves it 0
+    {"chain_append", test_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      handle := test_uintptr(0)
+      if key != nil {
+        handle = chain_init(key)
+        free_cstring(drain_audit_log())
+      }
+      free_cstring(chain_append(handle, input))
+      chain_free(handle)
+    })},
+    {"chain_verify", test_key, chain_records, STATUS_MALFORMED, records_size, hex_call(func(key, input c_string) {
+      chain_verify(key, input)
+    })},
+    {"derive_key", test_key, strings.Repeat("00", salt_length), STATUS_BAD_HEX, func(string) int64 { return 0 }, hex_call(func(key, input c_string) {
+      free_cstring(derive_key(key, input, 0))
+    })},
+    {"hmac_sha256", test_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      free_cstring(hmac_sha256(key, input))
+    })},
+    {"hmac_verify", test_key, cleartext, STATUS_BAD_HEX, hex_input_size, hex_call(func(key, input c_string) {
+      hmac_verify(key, input, tag)
+    })},
+    {"decrypt_stream", test_key, ciphertext, STATUS_MALFORMED, raw_size, func(key c_string, input string) {
+      handle := decrypt_stream_init(key)
+      if handle == 0 {
+        return
+      }
+      data, size := test_bytes(raw_bytes(input))
+      defer test_free(data)
+      free_cstring(decrypt_stream_update(handle, data, size, out_len))
+      free_cstring(decrypt_stream_final(handle, out_len))
+    }},
+    {"encrypt_stream", test_key, cleartext, STATUS_OK, raw_size, func(key c_string, input string) {
+      handle := encrypt_stream_init(key)
+      if handle == 0 {
+        return
+      }
+      data, size := test_bytes(raw_bytes(input))
+      defer test_free(data)
+      free_cstring(encrypt_stream_update(handle, data, size, out_len))
+      free_cstring(encrypt_stream_final(handle, out_len))
+    }},
+  }
+  drain_records(t)
+  for _, test := range cases {
+    case_key := test_cstring(test.key)
+    runs := []struct {
+      name   string
+      key    c_string
+      input  string
+      status int
+    }{
+      {"NULL key", nil, test.input, STATUS_BAD_ARG},
+      {"garbage", case_key, "zz", test.garbage},
+      {"valid", case_key, test.input, STATUS_OK},
+    }
+    for _, run := range runs {
+      test.call(run.key, run.input)
+      records := drain_records(t)
+      if len(records) != 1 {
+        t.Errorf("%s, %s: %d audit records", test.operation, run.name, len(records))
+        continue
+      }
+      want := audit_record{Operation: test.operation, Status: run.status, Size: test.size(run.input)}
+      if run.key != nil {
+        want.Key = fingerprint([]byte(test.key))
+      } else if strings.HasSuffix(test.operation, "_stream") {
+        // The stream is never opened, so nothing is fed
+        want.Size = 0
+      } else if test.operation == "chain_append" {
+        // The chain is never opened, its handle 0 is unknown
+        want.Status = STATUS_BAD_HANDLE
+      }
+      record := records[0]
+      record.Time = ""
+      if record != want {
+        t.Errorf("%s, %s: logged %+v, want %+v", test.operation, run.name, record, want)
+      }
+    }
+    test_free(case_key)
+  }
+}
+
+func TestAuditStreamFreedUnfinished(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  drain_records(t)
+  encrypt_stream_free(encrypt_stream_init(key))
+  records := drain_records(t)
+  if len(records) != 1 || records[0].Operation != "encrypt_stream" || records[0].Status != STATUS_CANCELLED {
+    t.Fatalf("freed stream logged %+v", records)
+  }
+}
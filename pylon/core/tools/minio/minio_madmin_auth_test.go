@@ -0,0 +1,58 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/hex"
+  "strings"
+  "testing"
+)
+
+func TestDecryptExSplitsWrongKeyFromCorrupt(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  // Three full packages
+  cleartext := test_cstring(strings.Repeat("5a", 3 * package_payload))
+  defer test_free(cleartext)
+  ciphertext, _ := hex.DecodeString(test_take(encrypt(key, cleartext)))
+  status := test_new_int()
+  decrypt_status := func(secret_key c_string, data []byte) int {
+    input := test_cstring(hex.EncodeToString(data))
+    defer test_free(input)
+    if result := test_take(decrypt_ex(secret_key, input, status)); test_int_of(status) != STATUS_OK && result != "" {
+      t.Fatalf("failed decrypt_ex returned %d hex digits", len(result))
+    }
+    return test_int_of(status)
+  }
+  if code := decrypt_status(key, ciphertext); code != STATUS_OK {
+    t.Fatalf("intact ciphertext: status %d", code)
+  }
+  wrong_key := test_cstring(test_key + "!")
+  defer test_free(wrong_key)
+  if code := decrypt_status(wrong_key, ciphertext); code != STATUS_WRONG_KEY {
+    t.Errorf("wrong key: status %d, want %d", code, STATUS_WRONG_KEY)
+  }
+  for idx := 0; idx < 3; idx++ {
+    for _, at := range []int{0, package_payload / 2, package_size - 1} {
+      flipped := append([]byte(nil), ciphertext...)
+      flipped[header_size + idx * package_size + at] ^= 0x01
+      if code := decrypt_status(key, flipped); code != STATUS_CORRUPT {
+        t.Errorf("byte %d of package %d flipped: status %d, want %d", at, idx, code, STATUS_CORRUPT)
+      }
+    }
+  }
+}
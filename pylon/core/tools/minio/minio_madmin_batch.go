@@ -0,0 +1,196 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "strings"
+  "unicode/utf16"
+  "unicode/utf8"
+)
+
+// batch_data applies operation to every hex item of a JSON array and returns
+// a JSON array in the same order, with null for items that failed
+func batch_data(inputs_json string, operation func(string) ([]byte, int)) *C.char {
+  var inputs []string
+  if err := json.Unmarshal([]byte(inputs_json), &inputs); err != nil {
+    fail(STATUS_BAD_ARG, err)
+    return C.CString("")
+  }
+  outputs := make([]*string, len(inputs))
+  for idx, input := range inputs {
+    data, status := operation(input)
+    if status != STATUS_OK {
+      continue
+    }
+    output := hex.EncodeToString(data)
+    outputs[idx] = &output
+  }
+  result, err := json.Marshal(outputs)
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
+
+// encrypt_batch encrypts a JSON array of hex cleartexts in one call and
+// returns a JSON array of hex ciphertexts, null marking failed items.
+// Returns empty string if inputs_json is not an array of strings.
+// Caller must free_cstring the result
+//export encrypt_batch
+func encrypt_batch(secret_key *C.char, inputs_json *C.char) *C.char {
+  clear_error()
+  call := audit_begin("encrypt_batch", secret_key, 0)
+  defer call.end()
+  if c_no_key(secret_key) || c_null(inputs_json) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return batch_data(C.GoString(inputs_json), func(input string) ([]byte, int) {
+    call.size += int64(len(strings.TrimSpace(input)) / 2)
+    return encrypt_data(key, input)
+  })
+}
+
+// decrypt_batch is the decrypt counterpart of encrypt_batch
+//export decrypt_batch
+func decrypt_batch(secret_key *C.char, inputs_json *C.char) *C.char {
+  clear_error()
+  call := audit_begin("decrypt_batch", secret_key, 0)
+  defer call.end()
+  if c_no_key(secret_key) || c_null(inputs_json) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return batch_data(C.GoString(inputs_json), func(input string) ([]byte, int) {
+    call.size += int64(len(strings.TrimSpace(input)) / 2)
+    return decrypt_data(key, input)
+  })
+}
+
+// json_secret decodes the JSON string raw as encoding/json would, but into
+// a slice the caller wipes instead of an immutable Go string. Bytes that
+// are not UTF-8 are kept as they are. null gives nil
+func json_secret(raw json.RawMessage) []byte {
+  if len(raw) < 2 || raw[0] != '"' {
+    return nil
+  }
+  secret := make([]byte, 0, len(raw) - 2)
+  var code [2]byte
+  defer wipe(code[:])
+  unicode := func(idx int) rune {
+    if idx + 6 > len(raw) - 1 || raw[idx] != '\\' || raw[idx + 1] != 'u' {
+      return -1
+    }
+    if _, err := hex.Decode(code[:], raw[idx + 2:idx + 6]); err != nil {
+      return -1
+    }
+    return rune(code[0]) << 8 | rune(code[1])
+  }
+  for idx := 1; idx < len(raw) - 1; idx++ {
+    if raw[idx] != '\\' {
+      secret = append(secret, raw[idx])
+      continue
+    }
+    idx++
+    switch raw[idx] {
+    case 'b':
+      secret = append(secret, '\b')
+    case 'f':
+      secret = append(secret, '\f')
+    case 'n':
+      secret = append(secret, '\n')
+    case 'r':
+      secret = append(secret, '\r')
+    case 't':
+      secret = append(secret, '\t')
+    case 'u':
+      char := unicode(idx - 1)
+      idx += 4
+      if utf16.IsSurrogate(char) {
+        char = utf16.DecodeRune(char, unicode(idx + 1))
+        if char != utf8.RuneError {
+          idx += 6
+        }
+      }
+      var encoded [utf8.UTFMax]byte
+      secret = append(secret, encoded[:utf8.EncodeRune(encoded[:], char)]...)
+      wipe(encoded[:])
+    default:
+      secret = append(secret, raw[idx])
+    }
+  }
+  return secret
+}
+
+// encrypt_multi encrypts one hex cleartext once per secret key of a JSON
+// array and returns a JSON array of hex ciphertexts in key order, null
+// marking keys that are null, empty or failed. Returns empty string if
+// keys_json is not an array or the cleartext is not valid hex. The call is
+// audited once, without a key fingerprint. Caller must free_cstring the result
+//export encrypt_multi
+func encrypt_multi(keys_json *C.char, cleartext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_multi", nil, c_hex_size(cleartext_hex)).end()
+  if c_null(keys_json, cleartext_hex) {
+    return C.CString("")
+  }
+  keys_data := c_secret(keys_json)
+  defer wipe(keys_data)
+  var keys []json.RawMessage
+  err := json.Unmarshal(keys_data, &keys)
+  for _, key := range keys {
+    defer wipe(key)
+    if err == nil && key[0] != '"' && string(key) != "null" {
+      err = errors.New("secret keys must be strings or null")
+    }
+  }
+  if err != nil {
+    fail(STATUS_BAD_ARG, err)
+    return C.CString("")
+  }
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(cleartext)
+  outputs := make([]*string, len(keys))
+  for idx, key := range keys {
+    secret := json_secret(key)
+    if len(secret) == 0 {
+      fail(STATUS_BAD_ARG, errors.New("secret key is null or empty"))
+      continue
+    }
+    data, status := encrypt_raw(secret, cleartext)
+    wipe(secret)
+    if status != STATUS_OK {
+      continue
+    }
+    output := hex.EncodeToString(data)
+    outputs[idx] = &output
+  }
+  result, err := json.Marshal(outputs)
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
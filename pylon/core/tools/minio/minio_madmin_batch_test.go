@@ -0,0 +1,111 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/json"
+  "strings"
+  "testing"
+)
+
+func TestBatchKeepsOrderAndMarksFailures(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  inputs := test_cstring(`["00", "zz", "0102"]`)
+  defer test_free(inputs)
+  var ciphertexts []*string
+  if err := json.Unmarshal([]byte(test_take(encrypt_batch(key, inputs))), &ciphertexts); err != nil {
+    t.Fatal(err)
+  }
+  if len(ciphertexts) != 3 || ciphertexts[0] == nil || ciphertexts[1] != nil || ciphertexts[2] == nil {
+    t.Fatalf("unexpected batch result %v", ciphertexts)
+  }
+  // Prepending a byte shifts the header, the middle item must fail alone
+  encoded, _ := json.Marshal([]string{*ciphertexts[0], "00" + *ciphertexts[0], *ciphertexts[2]})
+  batch := test_cstring(string(encoded))
+  defer test_free(batch)
+  if result := test_take(decrypt_batch(key, batch)); result != `["00",null,"0102"]` {
+    t.Fatalf("decrypt_batch gave %s", result)
+  }
+}
+
+func TestBatchRejectsInvalidJSON(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  for _, inputs_json := range []string{"", "{}", `["00", 1]`} {
+    inputs := test_cstring(inputs_json)
+    result := test_take(encrypt_batch(key, inputs))
+    test_free(inputs)
+    if result != "" {
+      t.Fatalf("encrypt_batch(%q) gave %q", inputs_json, result)
+    }
+    if test_take(last_error()) == "" {
+      t.Fatalf("encrypt_batch(%q) recorded no error", inputs_json)
+    }
+  }
+}
+
+func TestJSONSecretDecodesLikeEncodingJSON(t *testing.T) {
+  for _, raw := range []string{`"k"`, `""`, `"a\"b\\c\/d"`, `"\b\f\n\r\t"`, `"é中"`, `"😀"`, `"\ud83dx"`, `"\ude00A"`, `"\u00e9\ud83d\ude00"`} {
+    var want string
+    if err := json.Unmarshal([]byte(raw), &want); err != nil {
+      t.Fatal(err)
+    }
+    if secret := json_secret(json.RawMessage(raw)); string(secret) != want {
+      t.Errorf("json_secret(%s) = %q, want %q", raw, secret, want)
+    }
+  }
+  if secret := json_secret(json.RawMessage("null")); secret != nil {
+    t.Errorf("json_secret(null) = %q", secret)
+  }
+}
+
+func TestEncryptMultiUsesEveryKey(t *testing.T) {
+  keys := []string{"first key", "kéy\n\U0001f600"}
+  encoded, _ := json.Marshal([]interface{}{keys[0], nil, "", keys[1]})
+  keys_json := test_cstring(strings.Replace(string(encoded), "\U0001f600", `\ud83d\ude00`, 1))
+  defer test_free(keys_json)
+  cleartext := test_cstring("c0ffee")
+  defer test_free(cleartext)
+  var ciphertexts []*string
+  if err := json.Unmarshal([]byte(test_take(encrypt_multi(keys_json, cleartext))), &ciphertexts); err != nil {
+    t.Fatal(err)
+  }
+  if len(ciphertexts) != 4 || ciphertexts[1] != nil || ciphertexts[2] != nil {
+    t.Fatalf("unexpected encrypt_multi result %v", ciphertexts)
+  }
+  for idx, ciphertext := range []*string{ciphertexts[0], ciphertexts[3]} {
+    if ciphertext == nil {
+      t.Fatalf("key %d failed", idx)
+    }
+    key, input := test_cstring(keys[idx]), test_cstring(*ciphertext)
+    result := test_take(decrypt(key, input))
+    test_free(key)
+    test_free(input)
+    if result != "c0ffee" {
+      t.Errorf("key %d: decrypted %q", idx, result)
+    }
+  }
+  for _, invalid := range []string{`{}`, `["k", 1]`} {
+    keys_json := test_cstring(invalid)
+    result := test_take(encrypt_multi(keys_json, cleartext))
+    test_free(keys_json)
+    if result != "" || thread_status() != STATUS_BAD_ARG {
+      t.Errorf("encrypt_multi(%s) gave %q, status %d", invalid, result, thread_status())
+    }
+  }
+}
@@ -0,0 +1,112 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "crypto/rand"
+  "encoding/json"
+  "time"
+  "github.com/secure-io/sio-go/sioutil"
+)
+
+const (
+  default_bench_mb         = 16
+  max_bench_mb             = 1024
+  default_bench_iterations = 3
+  max_bench_iterations     = 1000
+)
+
+type benchmark_info struct {
+  Cipher      string  `json:"cipher"`
+  NativeAES   bool    `json:"native_aes"`
+  PayloadMB   int     `json:"payload_mb"`
+  Iterations  int     `json:"iterations"`
+  EncryptMBps float64 `json:"encrypt_mb_per_s"`
+  DecryptMBps float64 `json:"decrypt_mb_per_s"`
+  Error       string  `json:"error,omitempty"`
+}
+
+func benchmark_data(payload_mb int, iterations int) benchmark_info {
+  info := benchmark_info{
+    Cipher:     cipher_names[aead_cipher(default_aead())],
+    NativeAES:  sioutil.NativeAES(),
+    PayloadMB:  payload_mb,
+    Iterations: iterations,
+  }
+  key := make([]byte, default_key_length)
+  defer wipe(key)
+  payload := make([]byte, payload_mb << 20)
+  if _, err := rand.Read(key); err != nil {
+    info.Error = err.Error()
+    return info
+  }
+  if _, err := rand.Read(payload); err != nil {
+    info.Error = err.Error()
+    return info
+  }
+  var encrypting, decrypting time.Duration
+  for idx := 0; idx < iterations; idx++ {
+    start := time.Now()
+    ciphertext, status := encrypt_raw(key, payload)
+    encrypting += time.Since(start)
+    if status != STATUS_OK {
+      info.Error = take_error()
+      return info
+    }
+    start = time.Now()
+    _, status = decrypt_raw(key, ciphertext)
+    decrypting += time.Since(start)
+    if status != STATUS_OK {
+      info.Error = take_error()
+      return info
+    }
+  }
+  total := float64(payload_mb * iterations)
+  info.EncryptMBps = total / encrypting.Seconds()
+  info.DecryptMBps = total / decrypting.Seconds()
+  return info
+}
+
+// benchmark encrypts and decrypts iterations times a crypto/rand buffer of
+// payload_mb MiB (0 or less for 16 MiB and 3 iterations, at most 1024 MiB
+// and 1000 iterations) and returns JSON with MiB/s for both directions,
+// the cipher used and whether AES is hardware accelerated. The timing
+// includes the Argon2id key derivation of every call, as in real use.
+// Caller must free_cstring the result
+//export benchmark
+func benchmark(payload_mb C.int, iterations C.int) *C.char {
+  clear_error()
+  defer count_export()
+  size, count := int(payload_mb), int(iterations)
+  if size <= 0 {
+    size = default_bench_mb
+  }
+  if count <= 0 {
+    count = default_bench_iterations
+  }
+  if size > max_bench_mb {
+    size = max_bench_mb
+  }
+  if count > max_bench_iterations {
+    count = max_bench_iterations
+  }
+  result, err := json.Marshal(benchmark_data(size, count))
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
@@ -0,0 +1,234 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdint.h>
+import "C"
+import (
+  "bytes"
+  "errors"
+  "io"
+  "io/ioutil"
+  "math"
+  "unsafe"
+  "github.com/minio/minio/pkg/madmin"
+)
+
+// decrypt_into writes the cleartext into caller owned out_buf and returns
+// the number of bytes written, or -STATUS_*. -STATUS_BUFFER_SMALL means
+// out_cap is not enough (see decrypt_size), nothing is written then
+//export decrypt_into
+func decrypt_into(secret_key *C.char, ciphertext_hex *C.char, out_buf *C.char, out_cap C.int) C.int {
+  clear_error()
+  defer audit_begin("decrypt_into", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex, out_buf) {
+    return -STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := decrypt_data(key, C.GoString(ciphertext_hex))
+  if status != STATUS_OK {
+    return C.int(-status)
+  }
+  defer wipe(data)
+  if len(data) > int(out_cap) {
+    return C.int(-fail(STATUS_BUFFER_SMALL, errors.New("cleartext does not fit out_buf")))
+  }
+  return C.int(copy(c_buffer(unsafe.Pointer(out_buf), len(data)), data))
+}
+
+// err_region_full is the only addr_writer failure, the cleartext is larger
+// than the region
+var err_region_full = errors.New("cleartext exceeds region capacity")
+
+// addr_writer writes into capacity bytes of caller owned memory at addr,
+// refusing any write that would not fit as a whole
+type addr_writer struct {
+  addr     unsafe.Pointer
+  capacity int64
+  offset   int64
+}
+
+func (w *addr_writer) Write(p []byte) (int, error) {
+  if int64(len(p)) > w.capacity - w.offset {
+    return 0, err_region_full
+  }
+  copy(c_buffer(unsafe.Pointer(uintptr(w.addr) + uintptr(w.offset)), len(p)), p)
+  w.offset += int64(len(p))
+  return len(p), nil
+}
+
+// wipe zeroes everything written so far
+func (w *addr_writer) wipe() {
+  for offset := int64(0); offset < w.offset; offset += 1 << 20 {
+    size := w.offset - offset
+    if size > 1 << 20 {
+      size = 1 << 20
+    }
+    wipe(c_buffer(unsafe.Pointer(uintptr(w.addr) + uintptr(offset)), int(size)))
+  }
+  w.offset = 0
+}
+
+func decrypt_to_addr_data(secret_key []byte, ciphertext []byte, region *addr_writer) int {
+  if empty_ciphertext(ciphertext) {
+    return STATUS_OK
+  }
+  info := inspect_data(ciphertext)
+  if !info.Complete {
+    return fail(STATUS_MALFORMED, errors.New(info.Error))
+  }
+  if info.TotalPayload > region.capacity {
+    return fail(STATUS_BUFFER_SMALL, err_region_full)
+  }
+  reader, status := decrypt_reader(secret_key, bytes.NewReader(ciphertext), nil)
+  if status != STATUS_OK {
+    return status
+  }
+  if _, err := io.Copy(region, reader); err != nil {
+    region.wipe()
+    switch err {
+    case madmin.ErrMaliciousData:
+      return fail(STATUS_AUTH_FAILED, err)
+    case err_region_full:
+      return fail(STATUS_BUFFER_SMALL, err)
+    }
+    return fail(STATUS_INTERNAL, err)
+  }
+  return STATUS_OK
+}
+
+// decrypt_to_addr decrypts straight into capacity bytes of caller managed
+// memory at addr, e.g. an mmap region, and returns the number of bytes
+// written or -STATUS_*. -STATUS_BUFFER_SMALL means the cleartext would not
+// fit, nothing is written then. On other failures whatever was written is
+// zeroed again. The caller keeps the region mapped and writable meanwhile,
+// addr is a void * (ctypes c_void_p)
+//export decrypt_to_addr
+func decrypt_to_addr(secret_key *C.char, ciphertext_hex *C.char, addr unsafe.Pointer, capacity C.longlong) C.longlong {
+  clear_error()
+  defer audit_begin("decrypt_to_addr", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return -STATUS_BAD_ARG
+  }
+  if addr == nil || capacity < 0 {
+    return C.longlong(-fail(STATUS_BAD_ARG, errors.New("invalid region address or capacity")))
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  region := &addr_writer{addr: addr, capacity: int64(capacity)}
+  if status := decrypt_to_addr_data(key, ciphertext, region); status != STATUS_OK {
+    return C.longlong(-status)
+  }
+  return C.longlong(region.offset)
+}
+
+// decrypt_size returns the exact cleartext length of ciphertext from
+// encrypt_chunked with chunk_size (0 for encrypt and every other export
+// using the default packages), or -STATUS_*. It is computed from the
+// ciphertext structure alone, so no key is needed and nothing is
+// authenticated: a wrong chunk_size gives a wrong length or
+// -STATUS_MALFORMED. Returns -STATUS_BAD_ARG for a bad chunk_size
+//export decrypt_size
+func decrypt_size(ciphertext_hex *C.char, chunk_size C.int) C.int {
+  clear_error()
+  defer count_export()
+  if c_null(ciphertext_hex) {
+    return -STATUS_BAD_ARG
+  }
+  size, ok := chunk_size_value(chunk_size)
+  if !ok {
+    return C.int(-fail(STATUS_BAD_ARG, errors.New("chunk size out of range")))
+  }
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  if empty_ciphertext(ciphertext) {
+    return 0
+  }
+  info := inspect_chunked(ciphertext, size)
+  if !info.Complete {
+    return C.int(-fail(STATUS_MALFORMED, errors.New(info.Error)))
+  }
+  return C.int(info.TotalPayload)
+}
+
+// decrypt_capped_data stops reading one byte past max_bytes, so at most
+// max_bytes + 1 cleartext bytes are ever held in memory
+func decrypt_capped_data(secret_key []byte, ciphertext []byte, max_bytes int64) ([]byte, int) {
+  if empty_ciphertext(ciphertext) {
+    return []byte{}, STATUS_OK
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return nil, status
+  }
+  reader, status := decrypt_reader(secret_key, bytes.NewReader(ciphertext), nil)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  data, err := ioutil.ReadAll(io.LimitReader(reader, max_bytes + 1))
+  if err == madmin.ErrMaliciousData {
+    return nil, fail(STATUS_AUTH_FAILED, err)
+  }
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if int64(len(data)) > max_bytes {
+    wipe(data)
+    return nil, fail(STATUS_TOO_LARGE, errors.New("cleartext exceeds max_bytes"))
+  }
+  return data, STATUS_OK
+}
+
+// decrypt_capped is decrypt_bytes for hex input from untrusted sources:
+// decryption is aborted with STATUS_TOO_LARGE as soon as the cleartext
+// grows past max_bytes, see encrypt_bytes for out_len and ownership.
+// max_bytes above 2 GiB - 1 is clamped, out_len could not report more
+//export decrypt_capped
+func decrypt_capped(secret_key *C.char, ciphertext_hex *C.char, max_bytes C.longlong, out_len *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_capped", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(out_len) {
+    c_set(out_len, -STATUS_BAD_ARG)
+    return nil
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    *out_len = -STATUS_BAD_HEX
+    return nil
+  }
+  limit := int64(max_bytes)
+  if limit < 0 {
+    limit = 0
+  }
+  if limit > math.MaxInt32 {
+    limit = math.MaxInt32
+  }
+  data, status := decrypt_capped_data(key, ciphertext, limit)
+  if status != STATUS_OK {
+    *out_len = C.int(-status)
+    return nil
+  }
+  defer wipe(data)
+  *out_len = C.int(len(data))
+  return c_bytes(data)
+}
@@ -0,0 +1,106 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "encoding/hex"
+  "strings"
+  "testing"
+  "unsafe"
+)
+
+func TestDecryptCappedRejectsJustOverLimit(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  // Past a package boundary, so the limit is hit inside the second one
+  size := package_payload + 100
+  cleartext := test_cstring(strings.Repeat("d1", size))
+  defer test_free(cleartext)
+  ciphertext := test_cstring(test_take(encrypt(key, cleartext)))
+  defer test_free(ciphertext)
+  out_len := test_new_int()
+  for _, limit := range []int{size, size + 1, 1 << 30} {
+    data := test_take_bytes(decrypt_capped(key, ciphertext, test_longlong(int64(limit)), out_len), out_len)
+    if test_int_of(out_len) != size || !bytes.Equal(data, bytes.Repeat([]byte{0xd1}, size)) {
+      t.Errorf("max_bytes %d: out_len %d", limit, test_int_of(out_len))
+    }
+  }
+  for _, limit := range []int{size - 1, package_payload, 0} {
+    if data := test_take_bytes(decrypt_capped(key, ciphertext, test_longlong(int64(limit)), out_len), out_len); test_int_of(out_len) != -STATUS_TOO_LARGE || data != nil {
+      t.Errorf("max_bytes %d: out_len %d, want %d", limit, test_int_of(out_len), -STATUS_TOO_LARGE)
+    }
+  }
+}
+
+func TestCiphertextSizeRejectsJustOverFormatLimit(t *testing.T) {
+  limit := int64(max_payload_size())
+  if limit != (1 << 32 - 1) * int64(package_payload) {
+    t.Fatalf("max_payload_size %d", limit)
+  }
+  if size := ciphertext_size(test_longlong(limit), 0); int64(size) != header_size + limit + (1 << 32 - 1) * package_overhead {
+    t.Errorf("at the limit: size %d", size)
+  }
+  if size := ciphertext_size(test_longlong(limit + 1), 0); size != -STATUS_TOO_LARGE {
+    t.Errorf("just over the limit: size %d, want %d", size, -STATUS_TOO_LARGE)
+  }
+}
+
+func TestDecryptToAddrStatuses(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring(strings.Repeat("9b", 2 * package_payload + 10))
+  defer test_free(cleartext)
+  ciphertext_hex := test_take(encrypt(key, cleartext))
+  ciphertext := test_cstring(ciphertext_hex)
+  defer test_free(ciphertext)
+  size := 2 * package_payload + 10
+  region := make([]byte, size)
+  if written := decrypt_to_addr(key, ciphertext, unsafe.Pointer(&region[0]), test_longlong(int64(size))); int(written) != size || !bytes.Equal(region, bytes.Repeat([]byte{0x9b}, size)) {
+    t.Fatalf("decrypt_to_addr wrote %d", written)
+  }
+  if written := decrypt_to_addr(key, ciphertext, unsafe.Pointer(&region[0]), test_longlong(int64(size - 1))); written != -STATUS_BUFFER_SMALL {
+    t.Errorf("region one byte short: %d, want %d", written, -STATUS_BUFFER_SMALL)
+  }
+  // The last package modified: what was written before is zeroed again
+  modified, _ := hex.DecodeString(ciphertext_hex)
+  modified[len(modified) - 1] ^= 0x01
+  input := test_cstring(hex.EncodeToString(modified))
+  defer test_free(input)
+  region = make([]byte, size)
+  if written := decrypt_to_addr(key, input, unsafe.Pointer(&region[0]), test_longlong(int64(size))); written != -STATUS_AUTH_FAILED {
+    t.Errorf("modified ciphertext: %d, want %d", written, -STATUS_AUTH_FAILED)
+  }
+  if !all_zero(region) {
+    t.Error("region not zeroed after the failure")
+  }
+  if written := decrypt_to_addr(key, ciphertext, nil, 10); written != -STATUS_BAD_ARG {
+    t.Errorf("NULL region: %d", written)
+  }
+}
+
+func TestCheckPayloadJustOverFormatLimit(t *testing.T) {
+  if status := check_payload(max_payload, package_payload); status != STATUS_OK {
+    t.Errorf("max_payload bytes: status %d", status)
+  }
+  if status := check_payload(max_payload + 1, package_payload); status != STATUS_TOO_LARGE {
+    t.Errorf("max_payload + 1 bytes: status %d, want %d", status, STATUS_TOO_LARGE)
+  }
+  if message := test_take(last_error()); message == "" {
+    t.Error("no last_error for the refused length")
+  }
+}
@@ -0,0 +1,176 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdint.h>
+import "C"
+import (
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "sync"
+)
+
+// Records of a chain are ordinary ciphertexts whose associated data is the
+// final tag (last package_overhead bytes) of the record before, the first
+// record binds chain_genesis instead. Dropping, inserting or reordering
+// records breaks the link of the record after. Dropping records from the
+// end leaves a valid shorter chain, callers needing to detect that must
+// keep the record count or last tag elsewhere
+var chain_genesis = []byte("pylon chain")
+
+// chain_context appends to a chain, it keeps the key until released
+type chain_context struct {
+  lock       sync.Mutex
+  secret_key []byte
+  previous   []byte
+}
+
+func is_chain_context(value interface{}) bool {
+  _, ok := value.(*chain_context)
+  return ok
+}
+
+// release wipes the key, the context is unusable afterwards
+func (ctx *chain_context) release() {
+  wipe(ctx.secret_key)
+  ctx.secret_key = nil
+}
+
+// chain_tag is the link a record hands to the next one
+func chain_tag(ciphertext []byte) []byte {
+  return append([]byte{}, ciphertext[len(ciphertext) - package_overhead:]...)
+}
+
+// chain_verify_data decrypts every record against the tag of the one
+// before, the cleartexts are discarded
+func chain_verify_data(secret_key []byte, records []string) int {
+  previous := chain_genesis
+  for idx, record := range records {
+    ciphertext, err := decode_hex(record)
+    if err != nil {
+      return fail(STATUS_BAD_HEX, fmt.Errorf("record %d: %v", idx, err))
+    }
+    if len(ciphertext) < header_size + package_overhead {
+      return fail(STATUS_MALFORMED, fmt.Errorf("record %d: not a ciphertext", idx))
+    }
+    cleartext, status := decrypt_aead(secret_key, ciphertext, previous)
+    wipe(cleartext)
+    if status != STATUS_OK {
+      return fail(status, fmt.Errorf("record %d: broken chain link", idx))
+    }
+    previous = chain_tag(ciphertext)
+  }
+  return STATUS_OK
+}
+
+// c_records_size is the number of bytes the hex records of a JSON array
+// stand for, 0 if it is not one
+func c_records_size(ptr *C.char) int64 {
+  var records []string
+  if ptr == nil || json.Unmarshal(c_view(ptr), &records) != nil {
+    return 0
+  }
+  size := int64(0)
+  for _, record := range records {
+    size += int64(len(record) / 2)
+  }
+  return size
+}
+
+// chain_init starts an append-only chain of records under secret_key and
+// returns a handle, or 0 on failure. The handle keeps a copy of the key
+// until released by chain_free
+//export chain_init
+func chain_init(secret_key *C.char) C.uintptr_t {
+  clear_error()
+  defer audit_begin("chain_init", secret_key, 0).end()
+  if c_no_key(secret_key) {
+    return 0
+  }
+  ctx := &chain_context{secret_key: c_secret(secret_key), previous: chain_genesis}
+  return C.uintptr_t(handle_put(ctx))
+}
+
+// chain_append encrypts the hex record linked to the record appended
+// before and returns its hex ciphertext, to be stored in order. On failure
+// the chain is left as it was and empty string is returned.
+// Caller must free_cstring the result
+//export chain_append
+func chain_append(handle C.uintptr_t, record_hex *C.char) *C.char {
+  clear_error()
+  call := audit_begin("chain_append", nil, c_hex_size(record_hex))
+  defer call.end()
+  if c_null(record_hex) {
+    return C.CString("")
+  }
+  ctx, ok := handle_get(uintptr(handle)).(*chain_context)
+  if !ok {
+    fail(STATUS_BAD_HANDLE, fmt.Errorf("unknown chain handle %d", uintptr(handle)))
+    return C.CString("")
+  }
+  ctx.lock.Lock()
+  defer ctx.lock.Unlock()
+  if ctx.secret_key == nil {
+    fail(STATUS_BAD_HANDLE, fmt.Errorf("chain handle %d was released", uintptr(handle)))
+    return C.CString("")
+  }
+  call.key = fingerprint(ctx.secret_key)
+  record, err := decode_hex(C.GoString(record_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(record)
+  data, status := encrypt_aead(ctx.secret_key, record, default_aead(), ctx.previous)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  ctx.previous = chain_tag(data)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// chain_free releases the chain handle and wipes its key
+//export chain_free
+func chain_free(handle C.uintptr_t) {
+  clear_error()
+  defer count_export()
+  ctx, ok := handle_take(uintptr(handle), is_chain_context).(*chain_context)
+  if !ok {
+    return
+  }
+  ctx.lock.Lock()
+  defer ctx.lock.Unlock()
+  ctx.release()
+}
+
+// chain_verify checks a JSON array of hex records in chain order. Returns
+// STATUS_OK, STATUS_AUTH_FAILED for a wrong key or a missing, modified or
+// misplaced record (last_error names the first bad one), STATUS_BAD_HEX
+// or STATUS_MALFORMED for input that is not a chain
+//export chain_verify
+func chain_verify(secret_key *C.char, records_json *C.char) C.int {
+  clear_error()
+  defer audit_begin("chain_verify", secret_key, c_records_size(records_json)).end()
+  if c_no_key(secret_key) || c_null(records_json) {
+    return STATUS_BAD_ARG
+  }
+  var records []string
+  if err := json.Unmarshal([]byte(C.GoString(records_json)), &records); err != nil {
+    return C.int(fail(STATUS_MALFORMED, err))
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return C.int(chain_verify_data(key, records))
+}
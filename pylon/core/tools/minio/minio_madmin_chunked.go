@@ -0,0 +1,204 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "github.com/minio/minio/pkg/madmin"
+  "github.com/secure-io/sio-go"
+)
+
+// Package payload sizes permitted by the sio format
+const (
+  min_chunk_size = 1
+  max_chunk_size = sio.MaxBufSize
+)
+
+// chunk_size_value maps 0 to the madmin default and rejects sizes outside
+// min_chunk_size..max_chunk_size, negative ones included
+func chunk_size_value(chunk_size C.int) (int, bool) {
+  size := int(chunk_size)
+  if size == 0 {
+    return package_payload, true
+  }
+  return size, size >= min_chunk_size && size <= max_chunk_size
+}
+
+func encrypt_chunked_data(secret_key []byte, cleartext []byte, chunk_size int) ([]byte, int) {
+  if status := check_payload(int64(len(cleartext)), chunk_size); status != STATUS_OK {
+    return nil, status
+  }
+  var buffer bytes.Buffer
+  writer, err := encrypt_chunked_writer(secret_key, &buffer, default_aead(), nil, chunk_size)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if _, err := writer.Write(cleartext); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if err := writer.Close(); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+func decrypt_chunked_data(secret_key []byte, ciphertext []byte, chunk_size int) ([]byte, int) {
+  if empty_ciphertext(ciphertext) {
+    return []byte{}, STATUS_OK
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return nil, status
+  }
+  reader, status := decrypt_chunked_reader(secret_key, bytes.NewReader(ciphertext), nil, chunk_size)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  data, err := ioutil.ReadAll(reader)
+  if err == madmin.ErrMaliciousData {
+    return nil, fail(STATUS_AUTH_FAILED, err)
+  }
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return data, STATUS_OK
+}
+
+// encrypt_chunked is encrypt with chunk_size bytes of cleartext per DARE
+// package instead of the madmin default of 16 KiB (chunk_size 0).
+// Permitted sizes are 1 byte to 16 MiB - 1. Every package adds a 16 byte
+// tag and is authenticated on its own, so smaller chunks make
+// decrypt_range_chunked touch less data around the requested range, while
+// larger chunks cut the tag overhead and per-package cost for bulk
+// throughput. The size is not recorded in the ciphertext: it can only be
+// decrypted by decrypt_chunked or decrypt_range_chunked given the same
+// chunk_size, and by madmin only if it is the default. Cleartext is limited
+// to 2^32 - 1 packages as in ciphertext_size, STATUS_TOO_LARGE beyond.
+// Returns empty string on bad hex or chunk_size. Caller must free_cstring the result
+//export encrypt_chunked
+func encrypt_chunked(secret_key *C.char, cleartext_hex *C.char, chunk_size C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_chunked", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) {
+    return C.CString("")
+  }
+  size, ok := chunk_size_value(chunk_size)
+  if !ok {
+    fail(STATUS_BAD_ARG, errors.New("chunk size out of range"))
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := encrypt_chunked_data(key, cleartext, size)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_chunked reverses encrypt_chunked with the same chunk_size,
+// caller must free_cstring the result
+//export decrypt_chunked
+func decrypt_chunked(secret_key *C.char, ciphertext_hex *C.char, chunk_size C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_chunked", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  size, ok := chunk_size_value(chunk_size)
+  if !ok {
+    fail(STATUS_BAD_ARG, errors.New("chunk size out of range"))
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := decrypt_chunked_data(key, ciphertext, size)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// ciphertext_size returns the exact ciphertext length encrypt_chunked (or
+// encrypt for chunk_size 0) produces for plaintext_len bytes: the header,
+// the cleartext and a tag per package, at least one. Computed without any
+// crypto. Returns -STATUS_BAD_ARG for a negative length or bad chunk_size,
+// -STATUS_TOO_LARGE past the format limit, see max_payload_size
+//export ciphertext_size
+func ciphertext_size(plaintext_len C.longlong, chunk_size C.int) C.longlong {
+  clear_error()
+  defer count_export()
+  size, ok := chunk_size_value(chunk_size)
+  if !ok || plaintext_len < 0 {
+    return C.longlong(-fail(STATUS_BAD_ARG, errors.New("invalid plaintext length or chunk size")))
+  }
+  length := int64(plaintext_len)
+  if status := check_payload(length, size); status != STATUS_OK {
+    return C.longlong(-status)
+  }
+  packages := (length + int64(size) - 1) / int64(size)
+  if packages == 0 {
+    packages = 1
+  }
+  return C.longlong(header_size + length + packages * package_overhead)
+}
+
+// decrypt_range_chunked is decrypt_range for ciphertext from encrypt_chunked
+// with the same chunk_size. Bad chunk_size reports STATUS_UNSUPPORTED
+//export decrypt_range_chunked
+func decrypt_range_chunked(secret_key *C.char, ciphertext_hex *C.char, offset C.longlong, length C.longlong, chunk_size C.int, out_len *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_range_chunked", secret_key, c_hex_size(ciphertext_hex)).end()
+  return decrypt_range_hex(secret_key, ciphertext_hex, offset, length, chunk_size, out_len)
+}
+
+func decrypt_range_hex(secret_key *C.char, ciphertext_hex *C.char, offset C.longlong, length C.longlong, chunk_size C.int, out_len *C.int) *C.char {
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(out_len) {
+    c_set(out_len, -STATUS_BAD_ARG)
+    return nil
+  }
+  size, ok := chunk_size_value(chunk_size)
+  if !ok {
+    *out_len = C.int(-fail(STATUS_UNSUPPORTED, errors.New("chunk size out of range")))
+    return nil
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    *out_len = -STATUS_BAD_HEX
+    return nil
+  }
+  data, status := decrypt_range_data(key, ciphertext, int64(offset), int64(length), size)
+  if status != STATUS_OK {
+    *out_len = C.int(-status)
+    return nil
+  }
+  defer wipe(data)
+  *out_len = C.int(len(data))
+  return c_bytes(data)
+}
@@ -0,0 +1,96 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "strings"
+  "testing"
+  "unsafe"
+)
+
+func TestCiphertextSizeMatchesOutput(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  for _, chunk_size := range []int{0, 1, 1000, 4096} {
+    size := chunk_size
+    if size == 0 {
+      size = package_payload
+    }
+    for _, length := range []int{0, 1, size - 1, size, size + 1, 3 * size + 7} {
+      cleartext := test_cstring(strings.Repeat("e7", length))
+      ciphertext := test_take(encrypt_chunked(key, cleartext, test_int(chunk_size)))
+      test_free(cleartext)
+      if ciphertext == "" && length > 0 {
+        t.Fatalf("encrypt_chunked %d bytes in %d: %s", length, chunk_size, test_take(last_error()))
+      }
+      if estimate := ciphertext_size(test_longlong(int64(length)), test_int(chunk_size)); int(estimate) != len(ciphertext) / 2 {
+        t.Errorf("%d bytes in chunks of %d: estimate %d, output %d", length, chunk_size, estimate, len(ciphertext) / 2)
+      }
+    }
+  }
+}
+
+func TestChunkSizeRejectsNegative(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring("00")
+  defer test_free(cleartext)
+  for _, chunk_size := range []int{-1, -5, -package_payload, max_chunk_size + 1} {
+    if size := ciphertext_size(10, test_int(chunk_size)); size != -STATUS_BAD_ARG {
+      t.Errorf("ciphertext_size(10, %d) = %d, want %d", chunk_size, size, -STATUS_BAD_ARG)
+    }
+    if result := test_take(encrypt_chunked(key, cleartext, test_int(chunk_size))); result != "" {
+      t.Errorf("encrypt_chunked with chunk size %d succeeded", chunk_size)
+    }
+  }
+}
+
+func TestEncryptChunkedRefusesPastFormatLimit(t *testing.T) {
+  // One byte packages cap the stream at 2^32 - 1 bytes. The length is
+  // refused before any byte is read, so the slice only has to claim it
+  limit := 1 << 32 - 1
+  backing := []byte{0}
+  cleartext := (*[1 << 33]byte)(unsafe.Pointer(&backing[0]))[:limit + 1:limit + 1]
+  if data, status := encrypt_chunked_data([]byte(test_key), cleartext, 1); status != STATUS_TOO_LARGE || data != nil {
+    t.Errorf("limit + 1 bytes: status %d, want %d", status, STATUS_TOO_LARGE)
+  }
+  if size := ciphertext_size(test_longlong(int64(limit) + 1), 1); size != -STATUS_TOO_LARGE {
+    t.Errorf("ciphertext_size(limit + 1, 1) = %d, want %d", size, -STATUS_TOO_LARGE)
+  }
+}
+
+func TestDecryptSizeOfChunkedOutput(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  for _, chunk_size := range []int{0, 1, 1000} {
+    for _, length := range []int{0, 1, 999, 1000, 1001, 2 * package_payload + 5} {
+      cleartext := test_cstring(strings.Repeat("5a", length))
+      ciphertext := test_cstring(test_take(encrypt_chunked(key, cleartext, test_int(chunk_size))))
+      size := decrypt_size(ciphertext, test_int(chunk_size))
+      test_free(cleartext)
+      test_free(ciphertext)
+      if int(size) != length {
+        t.Errorf("%d bytes in chunks of %d: decrypt_size %d", length, chunk_size, size)
+      }
+    }
+  }
+  empty := test_cstring("")
+  defer test_free(empty)
+  if size := decrypt_size(empty, -1); size != -STATUS_BAD_ARG {
+    t.Errorf("decrypt_size with chunk size -1 = %d, want %d", size, -STATUS_BAD_ARG)
+  }
+}
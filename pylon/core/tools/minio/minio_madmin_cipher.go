@@ -0,0 +1,153 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/hex"
+  "errors"
+  "sync"
+  "time"
+  "github.com/secure-io/sio-go/sioutil"
+)
+
+// Cipher ids used by the exports. These differ from the AEAD ID byte
+// stored in the ciphertext header, so 0 can mean "auto"
+const (
+  CIPHER_AUTO     = 0
+  CIPHER_AES_GCM  = 1
+  CIPHER_CHACHA20 = 2
+)
+
+// Work of the autoselect benchmark: autoselect_rounds seals of one
+// package per cipher, about a millisecond in total
+const autoselect_rounds = 16
+
+var (
+  autoselect_once sync.Once
+  autoselect_id   byte
+)
+
+// autoselect_time is how long autoselect_rounds package seals take with id
+func autoselect_time(id byte, key []byte, data []byte) time.Duration {
+  aead, err := key_aead(key, id)
+  if err != nil {
+    return time.Duration(1 << 62)
+  }
+  nonce := make([]byte, aead.NonceSize())
+  out := make([]byte, 0, len(data) + aead.Overhead())
+  start := time.Now()
+  for round := 0; round < autoselect_rounds; round++ {
+    aead.Seal(out, nonce, data, nil)
+  }
+  return time.Since(start)
+}
+
+// autoselected_aead benchmarks both ciphers on first use and returns the
+// faster one from then on, measuring default_aead's pick first so a tie
+// keeps it
+func autoselected_aead() byte {
+  autoselect_once.Do(func() {
+    key := sioutil.MustRandom(32)
+    defer wipe(key)
+    data := make([]byte, package_payload)
+    autoselect_id = default_aead()
+    other := byte(aead_aes_gcm)
+    if autoselect_id == aead_aes_gcm {
+      other = aead_c20p1305
+    }
+    if autoselect_time(other, key, data) < autoselect_time(autoselect_id, key, data) {
+      autoselect_id = other
+    }
+  })
+  return autoselect_id
+}
+
+func cipher_aead(cipher_id int) (byte, bool) {
+  switch cipher_id {
+  case CIPHER_AUTO:
+    return autoselected_aead(), true
+  case CIPHER_AES_GCM:
+    return aead_aes_gcm, true
+  case CIPHER_CHACHA20:
+    return aead_c20p1305, true
+  }
+  return 0, false
+}
+
+func aead_cipher(id byte) int {
+  if id == aead_aes_gcm {
+    return CIPHER_AES_GCM
+  }
+  return CIPHER_CHACHA20
+}
+
+// encrypt_with_cipher is encrypt_ex with explicit cipher_id
+// (0 - auto, see autoselect_cipher, 1 - AES-256-GCM, 2 - ChaCha20-Poly1305).
+// Unknown ids report STATUS_UNSUPPORTED. Caller must free_cstring the result
+//export encrypt_with_cipher
+func encrypt_with_cipher(secret_key *C.char, cleartext_hex *C.char, cipher_id C.int, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_with_cipher", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  id, ok := cipher_aead(int(cipher_id))
+  if !ok {
+    *status = C.int(fail(STATUS_UNSUPPORTED, errors.New("unknown cipher id")))
+    return C.CString("")
+  }
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    *status = STATUS_BAD_HEX
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, code := encrypt_aead(key, cleartext, id, nil)
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// autoselect_cipher returns the cipher id that cipher id 0 (auto) stands
+// for: the faster of the two on this CPU, measured by a short benchmark
+// on first use and cached for the life of the process. Plain encrypt keeps
+// madmin's choice, see capabilities "default_cipher". Callers wanting a
+// fixed cipher pass id 1 or 2 explicitly instead of 0
+//export autoselect_cipher
+func autoselect_cipher() C.int {
+  clear_error()
+  defer count_export()
+  return C.int(aead_cipher(autoselected_aead()))
+}
+
+// detect_cipher returns the cipher id used by ciphertext, or -STATUS_*
+//export detect_cipher
+func detect_cipher(ciphertext_hex *C.char) C.int {
+  clear_error()
+  defer count_export()
+  if c_null(ciphertext_hex) {
+    return -STATUS_BAD_ARG
+  }
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return C.int(-status)
+  }
+  return C.int(aead_cipher(ciphertext[32]))
+}
@@ -0,0 +1,124 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/hex"
+  "errors"
+  "io"
+  "io/ioutil"
+)
+
+// First cleartext byte of compressed ciphertexts tells how the rest is stored
+const (
+  marker_raw  = 0x00
+  marker_gzip = 0x01
+)
+
+// compress_data prepends the marker, gzip is only used if it actually helps
+func compress_data(data []byte) []byte {
+  var buffer bytes.Buffer
+  buffer.WriteByte(marker_gzip)
+  writer := gzip.NewWriter(&buffer)
+  if _, err := writer.Write(data); err == nil && writer.Close() == nil && buffer.Len() < len(data) + 1 {
+    return buffer.Bytes()
+  }
+  return append([]byte{marker_raw}, data...)
+}
+
+// decompress_data takes empty data, the cleartext of empty_ciphertext, as
+// an empty cleartext
+func decompress_data(data []byte) ([]byte, int) {
+  if len(data) == 0 {
+    return nil, STATUS_OK
+  }
+  switch data[0] {
+  case marker_raw:
+    return data[1:], STATUS_OK
+  case marker_gzip:
+    return inflate_data(data[1:], max_payload)
+  }
+  return nil, fail(STATUS_MALFORMED, errors.New("unknown compression marker"))
+}
+
+// inflate_data gunzips data, refusing output past limit bytes with
+// STATUS_TOO_LARGE rather than inflating a gzip bomb without bound
+func inflate_data(data []byte, limit int64) ([]byte, int) {
+  reader, err := gzip.NewReader(bytes.NewReader(data))
+  if err != nil {
+    return nil, fail(STATUS_MALFORMED, err)
+  }
+  result, err := ioutil.ReadAll(io.LimitReader(reader, limit + 1))
+  if err != nil {
+    wipe(result)
+    return nil, fail(STATUS_MALFORMED, err)
+  }
+  if int64(len(result)) > limit {
+    wipe(result)
+    return nil, fail(STATUS_TOO_LARGE, errors.New("decompressed cleartext exceeds the format limit"))
+  }
+  return result, STATUS_OK
+}
+
+// encrypt_compressed gzips the cleartext before encrypting it. Note that
+// compressing secrets mixed with attacker controlled data before encryption
+// leaks information through the ciphertext length (CRIME/BREACH style), so
+// only use it where that does not apply. Caller must free_cstring the result
+//export encrypt_compressed
+func encrypt_compressed(secret_key *C.char, cleartext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_compressed", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := encrypt_raw(key, compress_data(cleartext))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_compressed reverses encrypt_compressed, inflating only if the
+// marker says the cleartext was compressed. Caller must free_cstring the result
+//export decrypt_compressed
+func decrypt_compressed(secret_key *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_compressed", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := decrypt_data(key, C.GoString(ciphertext_hex))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  result, status := decompress_data(data)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(result)
+  return C.CString(hex.EncodeToString(result))
+}
@@ -0,0 +1,49 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestInflateStopsAtLimit(t *testing.T) {
+  data := compress_data(make([]byte, 1000))
+  if data[0] != marker_gzip {
+    t.Fatal("zeros were not compressed")
+  }
+  if result, status := inflate_data(data[1:], 1000); status != STATUS_OK || len(result) != 1000 {
+    t.Errorf("limit 1000: status %d, %d bytes", status, len(result))
+  }
+  if result, status := inflate_data(data[1:], 999); status != STATUS_TOO_LARGE || result != nil {
+    t.Errorf("limit 999: status %d, want %d", status, STATUS_TOO_LARGE)
+  }
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  for _, cleartext := range []string{"", "c0ffee", strings.Repeat("00", 4096)} {
+    input := test_cstring(cleartext)
+    ciphertext := test_cstring(test_take(encrypt_compressed(key, input)))
+    result := test_take(decrypt_compressed(key, ciphertext))
+    test_free(input)
+    test_free(ciphertext)
+    if result != cleartext {
+      t.Errorf("%d hex digits came back as %d", len(cleartext), len(result))
+    }
+  }
+}
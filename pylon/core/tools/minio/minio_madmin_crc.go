@@ -0,0 +1,117 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "hash/crc32"
+)
+
+// CRC32C (Castagnoli) is a checksum, not a MAC: it catches accidental
+// corruption only, anyone can recompute it. The AEAD tags remain the
+// security control
+var crc_table = crc32.MakeTable(crc32.Castagnoli)
+
+const crc_size = 4
+
+// crc32_hex returns the big endian CRC32C of data as 8 hex digits, or
+// empty string on bad hex. Caller must free_cstring the result
+//export crc32_hex
+func crc32_hex(data_hex *C.char) *C.char {
+  clear_error()
+  defer count_export()
+  if c_null(data_hex) {
+    return C.CString("")
+  }
+  data, err := decode_hex(C.GoString(data_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  sum := make([]byte, crc_size)
+  binary.BigEndian.PutUint32(sum, crc32.Checksum(data, crc_table))
+  return C.CString(hex.EncodeToString(sum))
+}
+
+// encrypt_with_crc is encrypt_ex that, if with_crc is non-zero, prepends a
+// CRC32C of the cleartext to it before encryption, for decrypt_with_crc
+// to check. Non-cryptographic, see crc_table. Without with_crc the output
+// is a plain ciphertext. Caller must free_cstring the result
+//export encrypt_with_crc
+func encrypt_with_crc(secret_key *C.char, cleartext_hex *C.char, with_crc C.int, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_with_crc", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    *status = STATUS_BAD_HEX
+    return C.CString("")
+  }
+  if with_crc != 0 {
+    sum := make([]byte, crc_size, crc_size + len(cleartext))
+    binary.BigEndian.PutUint32(sum, crc32.Checksum(cleartext, crc_table))
+    cleartext = append(sum, cleartext...)
+    defer wipe(cleartext)
+  }
+  data, code := encrypt_raw(key, cleartext)
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_with_crc reverses encrypt_with_crc given the same with_crc and
+// returns the cleartext. crc_ok is set to 1 if the CRC32C matches (or
+// with_crc is zero) and to 0 if not, the cleartext is returned either way
+// as the AEAD tags already authenticated it. Empty ciphertext and cleartext
+// carry no CRC, crc_ok is 1 for them. Caller must free_cstring the result
+//export decrypt_with_crc
+func decrypt_with_crc(secret_key *C.char, ciphertext_hex *C.char, with_crc C.int, status *C.int, crc_ok *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_with_crc", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status, crc_ok) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  *crc_ok = 0
+  data, code := decrypt_data(key, C.GoString(ciphertext_hex))
+  if code != STATUS_OK {
+    *status = C.int(code)
+    return C.CString("")
+  }
+  defer wipe(data)
+  if with_crc != 0 && len(data) > 0 {
+    if len(data) < crc_size {
+      *status = C.int(fail(STATUS_MALFORMED, errors.New("cleartext shorter than CRC")))
+      return C.CString("")
+    }
+    sum, cleartext := binary.BigEndian.Uint32(data), data[crc_size:]
+    if sum == crc32.Checksum(cleartext, crc_table) {
+      *crc_ok = 1
+    }
+    data = cleartext
+  } else {
+    *crc_ok = 1
+  }
+  *status = STATUS_OK
+  return C.CString(hex.EncodeToString(data))
+}
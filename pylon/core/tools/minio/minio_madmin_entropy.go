@@ -0,0 +1,83 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "encoding/hex"
+  "errors"
+)
+
+// Bytes of caller supplied entropy consumed per ciphertext: the 32 bytes
+// salt followed by the 8 bytes nonce
+const entropy_size = 32 + 8
+
+// encrypt_seeded_data encrypts under the given salt and nonce instead of
+// fresh crypto/rand ones
+func encrypt_seeded_data(secret_key []byte, cleartext []byte, salt []byte, nonce []byte) ([]byte, int) {
+  var buffer bytes.Buffer
+  writer, err := encrypt_seeded_writer(secret_key, &buffer, default_aead(), nil, package_payload, salt, nonce)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if _, err := writer.Write(cleartext); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if err := writer.Close(); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+// encrypt_with_entropy is encrypt drawing the salt and nonce from the
+// first 40 bytes of entropy_hex (32 salt, then 8 nonce) instead of
+// crypto/rand, e.g. from an HSM. Less than 40 bytes is an error, any more
+// are ignored. The caller takes over the job of crypto/rand: the entropy
+// must be uniformly random and never supplied twice. The nonce alone is
+// only 64 bits and the salt is what keeps the derived keys apart, so
+// reused or predictable entropy under the same secret key repeats the
+// keystream and breaks confidentiality and authenticity of every
+// ciphertext involved. Returns empty string on failure.
+// Caller must free_cstring the result
+//export encrypt_with_entropy
+func encrypt_with_entropy(secret_key *C.char, cleartext_hex *C.char, entropy_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_with_entropy", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex, entropy_hex) {
+    return C.CString("")
+  }
+  entropy, err := decode_hex(C.GoString(entropy_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(entropy)
+  if len(entropy) < entropy_size {
+    fail(STATUS_BAD_ARG, errors.New("entropy must be at least 40 bytes"))
+    return C.CString("")
+  }
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(cleartext)
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := encrypt_seeded_data(key, cleartext, entropy[:32], entropy[32:entropy_size])
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
@@ -0,0 +1,137 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <pthread.h>
+// #include <stdlib.h>
+//
+// struct pylon_error {
+//   unsigned long generation;
+//   int status;
+//   char* message;
+// };
+//
+// static pthread_key_t pylon_error_key;
+// static pthread_once_t pylon_error_once = PTHREAD_ONCE_INIT;
+//
+// static void pylon_error_free(void* ptr) {
+//   struct pylon_error* error = ptr;
+//   free(error->message);
+//   free(error);
+// }
+//
+// static void pylon_error_init(void) {
+//   pthread_key_create(&pylon_error_key, pylon_error_free);
+// }
+//
+// static struct pylon_error* pylon_error_get(int create) {
+//   pthread_once(&pylon_error_once, pylon_error_init);
+//   struct pylon_error* error = pthread_getspecific(pylon_error_key);
+//   if (error == NULL && create) {
+//     error = calloc(1, sizeof(struct pylon_error));
+//     if (error != NULL && pthread_setspecific(pylon_error_key, error) != 0) {
+//       free(error);
+//       error = NULL;
+//     }
+//   }
+//   return error;
+// }
+import "C"
+import (
+  "sync/atomic"
+  "unsafe"
+)
+
+// Each call from C runs on a goroutine locked to the calling OS thread, so
+// the status and message of that thread's most recent call are kept in
+// thread-specific storage, which is freed when the thread exits.
+// Goroutines started by the library must lock their thread for as long as
+// they fail and take_error. errors_reset bumps errors_generation, messages
+// of older ones are stale
+
+var errors_generation uint64
+
+// clear_error is called first thing by every export
+func clear_error() {
+  slot := C.pylon_error_get(0)
+  if slot != nil {
+    C.free(unsafe.Pointer(slot.message))
+    slot.message = nil
+    slot.status = STATUS_OK
+  }
+}
+
+// fail records err for last_error and returns status unchanged
+func fail(status int, err error) int {
+  slot := C.pylon_error_get(1)
+  if slot == nil {
+    return status
+  }
+  C.free(unsafe.Pointer(slot.message))
+  slot.message = C.CString(err.Error())
+  slot.status = C.int(status)
+  slot.generation = C.ulong(atomic.LoadUint64(&errors_generation))
+  return status
+}
+
+// fail_as records status for the failure already recorded, keeping its
+// message, for callers that refine a status after the fact
+func fail_as(status int) int {
+  slot := C.pylon_error_get(0)
+  if slot != nil && slot.message != nil {
+    slot.status = C.int(status)
+  }
+  return status
+}
+
+// thread_status returns the status recorded on the current thread since
+// its last clear_error, STATUS_OK if nothing failed
+func thread_status() int {
+  slot := C.pylon_error_get(0)
+  if slot == nil || slot.message == nil || uint64(slot.generation) != atomic.LoadUint64(&errors_generation) {
+    return STATUS_OK
+  }
+  return int(slot.status)
+}
+
+// thread_error returns the message recorded on the current thread
+func thread_error() string {
+  slot := C.pylon_error_get(0)
+  if slot == nil || slot.message == nil || uint64(slot.generation) != atomic.LoadUint64(&errors_generation) {
+    return ""
+  }
+  return C.GoString(slot.message)
+}
+
+// errors_reset forgets the messages of all threads
+func errors_reset() {
+  atomic.AddUint64(&errors_generation, 1)
+}
+
+// take_error returns and clears the message recorded on the current thread
+func take_error() string {
+  message := thread_error()
+  clear_error()
+  return message
+}
+
+// last_error returns the error message of the most recent failing call on
+// the current thread, or empty string if that call succeeded. Meant for
+// diagnostics only, the messages are not part of the library interface.
+// Caller must free_cstring the result
+//export last_error
+func last_error() *C.char {
+  return C.CString(thread_error())
+}
@@ -0,0 +1,130 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "runtime"
+  "sync"
+  "testing"
+)
+
+// Run with: go test -tags testutil -race -run Concurrent .
+
+// Goroutines stand in for the threads of a C caller, each locked to its
+// own OS thread the way cgo runs an export
+const (
+  concurrent_rawkey_workers = 256
+  concurrent_argon2_workers = 4
+  concurrent_rounds         = 4
+)
+
+func TestConcurrentRoundTripsAndErrors(t *testing.T) {
+  raw_key := test_cstring(hex.EncodeToString(make([]byte, raw_key_length)))
+  defer test_free(raw_key)
+  key := test_cstring(test_key)
+  defer test_free(key)
+  failures := make(chan string, concurrent_rawkey_workers + concurrent_argon2_workers)
+  var group sync.WaitGroup
+  worker := func(worker int, argon2 bool) {
+    defer group.Done()
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    for round := 0; round < concurrent_rounds; round++ {
+      cleartext_hex := hex.EncodeToString([]byte(fmt.Sprintf("worker %d round %d", worker, round)))
+      cleartext := test_cstring(cleartext_hex)
+      var result string
+      if argon2 {
+        ciphertext := test_cstring(test_take(encrypt(key, cleartext)))
+        result = test_take(decrypt(key, ciphertext))
+        test_free(ciphertext)
+      } else {
+        ciphertext := test_cstring(test_take(encrypt_rawkey(raw_key, cleartext)))
+        result = test_take(decrypt_rawkey(raw_key, ciphertext))
+        test_free(ciphertext)
+      }
+      test_free(cleartext)
+      if result != cleartext_hex {
+        failures <- fmt.Sprintf("worker %d round %d: decrypted %q", worker, round, result)
+        return
+      }
+      if message := test_take(last_error()); message != "" {
+        failures <- fmt.Sprintf("worker %d round %d: successful call left error %q", worker, round, message)
+        return
+      }
+      message := fmt.Sprintf("failure of worker %d round %d", worker, round)
+      fail(STATUS_INTERNAL, errors.New(message))
+      runtime.Gosched()
+      if recorded := test_take(last_error()); recorded != message {
+        failures <- fmt.Sprintf("worker %d round %d: last_error %q", worker, round, recorded)
+        return
+      }
+    }
+  }
+  for idx := 0; idx < concurrent_rawkey_workers; idx++ {
+    group.Add(1)
+    go worker(idx, false)
+  }
+  for idx := 0; idx < concurrent_argon2_workers; idx++ {
+    group.Add(1)
+    go worker(concurrent_rawkey_workers + idx, true)
+  }
+  group.Wait()
+  close(failures)
+  for failure := range failures {
+    t.Error(failure)
+  }
+}
+
+func TestErrorsResetForgetsOtherThreads(t *testing.T) {
+  recorded := make(chan struct{})
+  checked := make(chan string)
+  go func() {
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    fail(STATUS_INTERNAL, errors.New("left behind"))
+    recorded <- struct{}{}
+    <-recorded
+    checked <- thread_error()
+  }()
+  <-recorded
+  errors_reset()
+  recorded <- struct{}{}
+  if message := <-checked; message != "" {
+    t.Fatalf("message %q survived errors_reset", message)
+  }
+}
+
+func TestErrorsFreedWithThread(t *testing.T) {
+  message := errors.New(string(make([]byte, 4096)) + "x")
+  // A goroutine exiting while locked takes its thread along
+  exit_thread := func() {
+    done := make(chan struct{})
+    go func() {
+      defer close(done)
+      runtime.LockOSThread()
+      fail(STATUS_INTERNAL, message)
+    }()
+    <-done
+  }
+  // 256 leaked messages of 4 KiB would be 1 MiB
+  if growth := heap_growth(256, exit_thread); growth > 256 << 10 {
+    t.Fatalf("C heap grew by %d bytes over 256 exited threads", growth)
+  }
+}
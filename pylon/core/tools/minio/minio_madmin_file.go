@@ -0,0 +1,381 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdint.h>
+import "C"
+import (
+  "bytes"
+  "context"
+  "errors"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync/atomic"
+  "syscall"
+)
+
+// progress_reader counts bytes read so far, the counter may be polled
+// from another thread while the copy is running
+type progress_reader struct {
+  reader  io.Reader
+  counter *int64
+}
+
+func (r *progress_reader) Read(p []byte) (int, error) {
+  n, err := r.reader.Read(p)
+  atomic.AddInt64(r.counter, int64(n))
+  return n, err
+}
+
+// cancel_reader stops reading as soon as ctx is done, so a copy is
+// interrupted between chunks
+type cancel_reader struct {
+  ctx    context.Context
+  reader io.Reader
+}
+
+func (r *cancel_reader) Read(p []byte) (int, error) {
+  if err := r.ctx.Err(); err != nil {
+    return 0, err
+  }
+  return r.reader.Read(p)
+}
+
+// encrypt_file_data encrypts in_path into out_path, counting cleartext bytes
+// processed in progress if it is not nil. Reports STATUS_CANCELLED once ctx
+// is done
+func encrypt_file_data(ctx context.Context, secret_key []byte, in_path string, out_path string, progress *int64) int {
+  file, err := os.Open(in_path)
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  defer file.Close()
+  var in io.Reader = &cancel_reader{ctx: ctx, reader: file}
+  if progress != nil {
+    in = &progress_reader{reader: in, counter: progress}
+  }
+  out, err := os.Create(out_path)
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  status := STATUS_OK
+  writer, err := encrypt_writer(secret_key, out, default_aead(), nil)
+  if err != nil {
+    status = fail(STATUS_IO_ERROR, err)
+  } else if _, err := io.Copy(writer, in); err != nil && ctx.Err() != nil {
+    status = fail(STATUS_CANCELLED, err)
+  } else if err != nil {
+    status = stream_status(err)
+  } else if err := writer.Close(); err != nil {
+    status = fail(STATUS_IO_ERROR, err)
+  }
+  if err := out.Close(); err != nil && status == STATUS_OK {
+    status = fail(STATUS_IO_ERROR, err)
+  }
+  if status != STATUS_OK {
+    os.Remove(out_path)
+  }
+  return status
+}
+
+func decrypt_file_data(secret_key []byte, in_path string, out_path string) int {
+  in, err := os.Open(in_path)
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  defer in.Close()
+  reader, status := decrypt_reader(secret_key, in, nil)
+  if status != STATUS_OK {
+    return status
+  }
+  out, err := os.Create(out_path)
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  if _, err := io.Copy(out, reader); err != nil {
+    status = stream_status(err)
+  }
+  if err := out.Close(); err != nil && status == STATUS_OK {
+    status = fail(STATUS_IO_ERROR, err)
+  }
+  if status != STATUS_OK {
+    os.Remove(out_path)
+  }
+  return status
+}
+
+// rekey_file_data re-encrypts path under new_key through a temporary file
+// in the same directory, which is synced and then renamed over path before
+// the directory is synced. On failure path is untouched and the temporary
+// file is removed, unless only the directory sync failed after the rename
+func rekey_file_data(old_key []byte, new_key []byte, path string) int {
+  in, err := os.Open(path)
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  defer in.Close()
+  info, err := in.Stat()
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  reader, status := decrypt_reader(old_key, in, nil)
+  if status != STATUS_OK {
+    return status
+  }
+  out, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".rekey-")
+  if err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  writer, err := encrypt_writer(new_key, out, default_aead(), nil)
+  if err != nil {
+    status = fail(STATUS_IO_ERROR, err)
+  } else if _, err := io.Copy(writer, reader); err != nil {
+    status = stream_status(err)
+  } else if err := writer.Close(); err != nil {
+    status = fail(STATUS_IO_ERROR, err)
+  } else if err := out.Chmod(info.Mode().Perm()); err != nil {
+    status = fail(STATUS_IO_ERROR, err)
+  } else if err := out.Sync(); err != nil {
+    status = fail(STATUS_IO_ERROR, err)
+  }
+  if err := out.Close(); err != nil && status == STATUS_OK {
+    status = fail(STATUS_IO_ERROR, err)
+  }
+  if status == STATUS_OK {
+    if err := os.Rename(out.Name(), path); err != nil {
+      status = fail(STATUS_IO_ERROR, err)
+    }
+  }
+  if status != STATUS_OK {
+    os.Remove(out.Name())
+    return status
+  }
+  if err := sync_dir(filepath.Dir(path)); err != nil {
+    return fail(STATUS_IO_ERROR, err)
+  }
+  return STATUS_OK
+}
+
+// sync_dir makes a rename in dir durable
+func sync_dir(dir string) error {
+  handle, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer handle.Close()
+  return handle.Sync()
+}
+
+// encrypt_file streams in_path into an encrypted out_path and returns
+// STATUS_*. A partial out_path is removed on failure
+//export encrypt_file
+func encrypt_file(secret_key *C.char, in_path *C.char, out_path *C.char) C.int {
+  clear_error()
+  defer audit_begin("encrypt_file", secret_key, c_path_size(in_path)).end()
+  if c_no_key(secret_key) || c_null(in_path, out_path) {
+    return STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return C.int(encrypt_file_data(context.Background(), key, C.GoString(in_path), C.GoString(out_path), nil))
+}
+
+// decrypt_file streams encrypted in_path into out_path and returns
+// STATUS_*. A partial out_path is removed on failure
+//export decrypt_file
+func decrypt_file(secret_key *C.char, in_path *C.char, out_path *C.char) C.int {
+  clear_error()
+  defer audit_begin("decrypt_file", secret_key, c_path_size(in_path)).end()
+  if c_no_key(secret_key) || c_null(in_path, out_path) {
+    return STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return C.int(decrypt_file_data(key, C.GoString(in_path), C.GoString(out_path)))
+}
+
+// rekey_file atomically replaces the encrypted file at path with its
+// re-encryption under new_key and returns STATUS_*. On failure the
+// original file is left as it was
+//export rekey_file
+func rekey_file(old_key *C.char, new_key *C.char, path *C.char) C.int {
+  clear_error()
+  defer audit_begin("rekey_file", new_key, c_path_size(path)).end()
+  if c_no_key(old_key) || c_no_key(new_key) || c_null(path) {
+    return STATUS_BAD_ARG
+  }
+  old_secret := c_secret(old_key)
+  defer wipe(old_secret)
+  new_secret := c_secret(new_key)
+  defer wipe(new_secret)
+  return C.int(rekey_file_data(old_secret, new_secret, C.GoString(path)))
+}
+
+func is_progress_counter(value interface{}) bool {
+  _, ok := value.(*int64)
+  return ok
+}
+
+// progress_init returns a handle for encrypt_file_progress, which must be
+// released with progress_free
+//export progress_init
+func progress_init() C.uintptr_t {
+  clear_error()
+  return C.uintptr_t(handle_put(new(int64)))
+}
+
+// progress_free releases a progress handle
+//export progress_free
+func progress_free(handle C.uintptr_t) {
+  clear_error()
+  defer count_export()
+  handle_take(uintptr(handle), is_progress_counter)
+}
+
+// stream_progress returns the number of bytes processed so far by the
+// operation using handle, or -1 for unknown handles. Safe to call
+// from any thread while the operation is running
+//export stream_progress
+func stream_progress(handle C.uintptr_t) C.longlong {
+  clear_error()
+  defer count_export()
+  counter, ok := handle_get(uintptr(handle)).(*int64)
+  if !ok {
+    return -1
+  }
+  return C.longlong(atomic.LoadInt64(counter))
+}
+
+// encrypt_file_progress is encrypt_file that reports cleartext bytes read
+// to the progress handle from progress_init, to be polled with
+// stream_progress from another thread
+//export encrypt_file_progress
+func encrypt_file_progress(secret_key *C.char, in_path *C.char, out_path *C.char, handle C.uintptr_t) C.int {
+  clear_error()
+  defer audit_begin("encrypt_file_progress", secret_key, c_path_size(in_path)).end()
+  if c_no_key(secret_key) || c_null(in_path, out_path) {
+    return STATUS_BAD_ARG
+  }
+  counter, ok := handle_get(uintptr(handle)).(*int64)
+  if !ok {
+    return C.int(fail(STATUS_BAD_HANDLE, errors.New("unknown progress handle")))
+  }
+  atomic.StoreInt64(counter, 0)
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return C.int(encrypt_file_data(context.Background(), key, C.GoString(in_path), C.GoString(out_path), counter))
+}
+
+// dup_file wraps a duplicate of fd, closing the os.File (explicitly or by
+// its finalizer) then leaves the caller's descriptor open
+func dup_file(fd int) (*os.File, int) {
+  dup, err := syscall.Dup(fd)
+  if err != nil {
+    return nil, fail(STATUS_IO_ERROR, err)
+  }
+  return os.NewFile(uintptr(dup), "fd"), STATUS_OK
+}
+
+func decrypt_to_fd_data(secret_key []byte, ciphertext []byte, fd int) (int64, int) {
+  if empty_ciphertext(ciphertext) {
+    return 0, STATUS_OK
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return 0, status
+  }
+  reader, status := decrypt_reader(secret_key, bytes.NewReader(ciphertext), nil)
+  if status != STATUS_OK {
+    return 0, status
+  }
+  out, status := dup_file(fd)
+  if status != STATUS_OK {
+    return 0, status
+  }
+  defer out.Close()
+  written, err := io.Copy(out, reader)
+  if err != nil {
+    return written, stream_status(err)
+  }
+  return written, STATUS_OK
+}
+
+// decrypt_to_fd streams the cleartext into the open file descriptor fd
+// (file, pipe or socket) without building it in memory and returns the
+// number of bytes written, or -STATUS_*. fd stays open. Packages are only
+// written once authenticated, but on a failure the packages before the bad
+// one have already been written
+//export decrypt_to_fd
+func decrypt_to_fd(secret_key *C.char, ciphertext_hex *C.char, fd C.int) C.longlong {
+  clear_error()
+  defer audit_begin("decrypt_to_fd", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return -STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  written, status := decrypt_to_fd_data(key, ciphertext, int(fd))
+  if status != STATUS_OK {
+    return C.longlong(-status)
+  }
+  return C.longlong(written)
+}
+
+func decrypt_from_fd_data(secret_key []byte, in_fd int, out_fd int) (int64, int) {
+  in, status := dup_file(in_fd)
+  if status != STATUS_OK {
+    return 0, status
+  }
+  defer in.Close()
+  out, status := dup_file(out_fd)
+  if status != STATUS_OK {
+    return 0, status
+  }
+  defer out.Close()
+  reader, status := decrypt_reader(secret_key, in, nil)
+  if status != STATUS_OK {
+    return 0, status
+  }
+  written, err := io.Copy(out, reader)
+  if err != nil {
+    return written, stream_status(err)
+  }
+  return written, STATUS_OK
+}
+
+// decrypt_from_fd reads raw ciphertext from in_fd until EOF and writes the
+// cleartext to out_fd, e.g. pipe to pipe, holding only one package at a
+// time. Returns the number of cleartext bytes written or -STATUS_*, see
+// decrypt_to_fd for partial output. Neither fd is closed
+//export decrypt_from_fd
+func decrypt_from_fd(secret_key *C.char, in_fd C.int, out_fd C.int) C.longlong {
+  clear_error()
+  defer audit_begin("decrypt_from_fd", secret_key, c_fd_size(in_fd)).end()
+  if c_no_key(secret_key) {
+    return -STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  written, status := decrypt_from_fd_data(key, int(in_fd), int(out_fd))
+  if status != STATUS_OK {
+    return C.longlong(-status)
+  }
+  return C.longlong(written)
+}
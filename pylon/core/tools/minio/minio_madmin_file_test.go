@@ -0,0 +1,56 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestRekeyFileReplacesInPlace(t *testing.T) {
+  dir, err := ioutil.TempDir("", "pylon-rekey")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "data")
+  ciphertext, status := encrypt_raw([]byte("old key"), []byte("cleartext"))
+  if status != STATUS_OK {
+    t.Fatalf("encrypt: status %d", status)
+  }
+  if err := ioutil.WriteFile(path, ciphertext, 0600); err != nil {
+    t.Fatal(err)
+  }
+  if status := rekey_file_data([]byte("old key"), []byte("new key"), path); status != STATUS_OK {
+    t.Fatalf("rekey_file_data: status %d", status)
+  }
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if cleartext, status := decrypt_aead([]byte("new key"), data, nil); status != STATUS_OK || !bytes.Equal(cleartext, []byte("cleartext")) {
+    t.Errorf("rekeyed file: status %d, cleartext %q", status, cleartext)
+  }
+  if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+    t.Errorf("%d files left in the directory", len(entries))
+  }
+  if err := sync_dir(filepath.Join(dir, "missing")); err == nil {
+    t.Error("sync_dir of a missing directory succeeded")
+  }
+}
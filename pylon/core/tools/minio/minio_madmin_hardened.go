@@ -0,0 +1,141 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "errors"
+)
+
+// decrypt_hardened targets an attacker timing many decrypt calls, e.g.
+// probing candidate keys, who must not learn whether an input failed as
+// bad hex, a malformed header, a wrong key or modified data. Every call
+// decodes all of its hex, derives the Argon2id key (which dominates the
+// cost of small inputs) and opens every package even after one failed.
+// Residual differences remain: the work grows with the input length, which
+// the caller picks anyway, empty input returns at once, and the derivation
+// and AEAD run at the speed of the host, not in constant time. Encoding the
+// result on success is the only extra step of that path
+
+// hardened_hex decodes hex without stopping at the first invalid digit
+func hardened_hex(data []byte) ([]byte, bool) {
+  data = bytes.TrimSpace(data)
+  valid := len(data) % 2 == 0
+  result := make([]byte, len(data) / 2)
+  for idx := range result {
+    high, high_ok := hex_digit(data[2 * idx])
+    low, low_ok := hex_digit(data[2 * idx + 1])
+    result[idx] = high << 4 | low
+    valid = valid && high_ok && low_ok
+  }
+  return result, valid
+}
+
+func hex_digit(char byte) (byte, bool) {
+  switch {
+  case char >= '0' && char <= '9':
+    return char - '0', true
+  case char >= 'a' && char <= 'f':
+    return char - 'a' + 10, true
+  case char >= 'A' && char <= 'F':
+    return char - 'A' + 10, true
+  }
+  return 0, false
+}
+
+// decrypt_hardened_data decrypts opening the packages one by one, invalid
+// input is processed as a ciphertext under a zero header all the same
+func decrypt_hardened_data(secret_key []byte, ciphertext_hex []byte) ([]byte, int) {
+  ciphertext, valid := hardened_hex(ciphertext_hex)
+  defer wipe(ciphertext)
+  if empty_ciphertext(ciphertext) && valid {
+    return nil, STATUS_OK
+  }
+  status := STATUS_OK
+  if !valid {
+    status = STATUS_BAD_HEX
+  }
+  header := make([]byte, header_size)
+  data := ciphertext
+  if len(ciphertext) >= header_size {
+    copy(header, ciphertext)
+    data = ciphertext[header_size:]
+  } else if status == STATUS_OK {
+    status = STATUS_MALFORMED
+  }
+  if header[32] != aead_aes_gcm && header[32] != aead_c20p1305 {
+    header[32] = aead_aes_gcm
+    if status == STATUS_OK {
+      status = STATUS_MALFORMED
+    }
+  }
+  aead, err := new_aead(secret_key, header[:32], header[32])
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  opener := new_package_opener(aead, header[33:])
+  cleartext := make([]byte, 0, len(data))
+  if len(data) == 0 && status == STATUS_OK {
+    status = STATUS_MALFORMED
+  }
+  for idx, offset := 0, 0; offset < len(data); idx, offset = idx + 1, offset + package_size {
+    end := offset + package_size
+    if end > len(data) {
+      end = len(data)
+    }
+    data_package := data[offset:end]
+    if len(data_package) < package_overhead {
+      data_package = make([]byte, package_overhead)
+      if status == STATUS_OK {
+        status = STATUS_MALFORMED
+      }
+    }
+    result, err := opener.open(cleartext, data_package, idx, end == len(data))
+    if err == nil {
+      cleartext = result
+    } else if status == STATUS_OK {
+      status = STATUS_AUTH_FAILED
+    }
+  }
+  if status != STATUS_OK {
+    wipe(cleartext[:cap(cleartext)])
+    return nil, fail(status, errors.New("decryption failed"))
+  }
+  return cleartext, STATUS_OK
+}
+
+// decrypt_hardened is decrypt_ex with the timing of failures normalized as
+// described above. The status still tells STATUS_BAD_HEX, STATUS_MALFORMED
+// and STATUS_AUTH_FAILED apart, last_error does not.
+// Caller must free_cstring the result
+//export decrypt_hardened
+func decrypt_hardened(secret_key *C.char, ciphertext_hex *C.char, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_hardened", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, code := decrypt_hardened_data(key, c_view(ciphertext_hex))
+  *status = C.int(code)
+  if code != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return c_hex(data)
+}
@@ -0,0 +1,83 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestDecryptHardenedTimingParity(t *testing.T) {
+  if testing.Short() {
+    t.Skip("timing runs several key derivations")
+  }
+  key := test_cstring(test_key)
+  defer test_free(key)
+  wrong_key := test_cstring(test_key + "!")
+  defer test_free(wrong_key)
+  cleartext := test_cstring(strings.Repeat("0f", 4 * package_payload))
+  defer test_free(cleartext)
+  ciphertext_hex := test_take(encrypt(key, cleartext))
+  ciphertext := test_cstring(ciphertext_hex)
+  defer test_free(ciphertext)
+  // Same length as the ciphertext, invalid in its last digit
+  malformed := test_cstring(ciphertext_hex[:len(ciphertext_hex) - 1] + "z")
+  defer test_free(malformed)
+  status := test_new_int()
+  cases := []struct {
+    name   string
+    key    c_string
+    input  c_string
+    status int
+  }{
+    {"malformed", key, malformed, STATUS_BAD_HEX},
+    {"wrong key", wrong_key, ciphertext, STATUS_AUTH_FAILED},
+    {"success", key, ciphertext, STATUS_OK},
+  }
+  // Fastest of interleaved rounds, so that load on the host affects all
+  // cases alike and stray slow runs drop out
+  fastest := make([]time.Duration, len(cases))
+  for round := 0; round < 5; round++ {
+    for idx, c := range cases {
+      start := time.Now()
+      free_cstring(decrypt_hardened(c.key, c.input, status))
+      elapsed := time.Since(start)
+      if test_int_of(status) != c.status {
+        t.Fatalf("%s: status %d, want %d", c.name, test_int_of(status), c.status)
+      }
+      if round == 0 || elapsed < fastest[idx] {
+        fastest[idx] = elapsed
+      }
+    }
+  }
+  low, high := fastest[0], fastest[0]
+  for _, elapsed := range fastest {
+    if elapsed < low {
+      low = elapsed
+    }
+    if elapsed > high {
+      high = elapsed
+    }
+  }
+  if float64(high) > 1.5 * float64(low) {
+    for idx, c := range cases {
+      t.Logf("%s: %v", c.name, fastest[idx])
+    }
+    t.Errorf("timing differs by %.2fx across the failure classes", float64(high) / float64(low))
+  }
+}
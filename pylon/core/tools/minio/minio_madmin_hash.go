@@ -0,0 +1,77 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "hash"
+  "io"
+  "unsafe"
+)
+
+// encrypt_hash_data encrypts and hashes the cleartext in a single pass
+func encrypt_hash_data(secret_key []byte, cleartext []byte, hasher hash.Hash) ([]byte, int) {
+  var buffer bytes.Buffer
+  writer, err := encrypt_writer(secret_key, &buffer, default_aead(), nil)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if _, err := io.MultiWriter(hasher, writer).Write(cleartext); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if err := writer.Close(); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+// encrypt_with_hash is encrypt also writing the hex SHA-256 of the
+// cleartext, NUL terminated, into caller owned hash_out. The hash does
+// not depend on the key, so it stays valid across rekey. hash_cap below
+// 65 fails with STATUS_BUFFER_SMALL before anything is encrypted.
+// Returns empty string on failure. Caller must free_cstring the result
+//export encrypt_with_hash
+func encrypt_with_hash(secret_key *C.char, cleartext_hex *C.char, hash_out *C.char, hash_cap C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_with_hash", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex, hash_out) {
+    return C.CString("")
+  }
+  hasher := sha256.New()
+  size := hex.EncodedLen(hasher.Size())
+  if int(hash_cap) < size + 1 {
+    fail(STATUS_BUFFER_SMALL, errors.New("hash_out can not hold the 64 hex digits and NUL"))
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(cleartext)
+  data, status := encrypt_hash_data(key, cleartext, hasher)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  out := c_buffer(unsafe.Pointer(hash_out), size + 1)
+  hex.Encode(out, hasher.Sum(nil))
+  out[size] = 0
+  return C.CString(hex.EncodeToString(data))
+}
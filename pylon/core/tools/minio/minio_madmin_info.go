@@ -0,0 +1,201 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "runtime"
+  "runtime/debug"
+  "sync"
+)
+
+// Set at build time, e.g. -ldflags "-X main.build_commit=$(git rev-parse HEAD)".
+// minio_version is only used when module build info is not available
+var (
+  build_commit  = "unknown"
+  build_time    = "unknown"
+  minio_version = "unknown"
+)
+
+type version_info struct {
+  MinIO     string `json:"minio"`
+  Go        string `json:"go"`
+  Commit    string `json:"commit"`
+  BuildTime string `json:"build_time"`
+}
+
+func module_version(path string, fallback string) string {
+  info, ok := debug.ReadBuildInfo()
+  if !ok {
+    return fallback
+  }
+  for _, module := range info.Deps {
+    if module.Path == path {
+      if module.Replace != nil {
+        return module.Replace.Version
+      }
+      return module.Version
+    }
+  }
+  return fallback
+}
+
+// version returns JSON with the compiled in github.com/minio/minio version,
+// Go version and build commit/time. Caller must free_cstring the result
+//export version
+func version() *C.char {
+  clear_error()
+  defer count_export()
+  result, err := json.Marshal(version_info{
+    MinIO:     module_version("github.com/minio/minio", minio_version),
+    Go:        runtime.Version(),
+    Commit:    build_commit,
+    BuildTime: build_time,
+  })
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
+
+type cipher_info struct {
+  ID   int    `json:"id"`
+  Name string `json:"name"`
+}
+
+type capabilities_info struct {
+  Ciphers       []cipher_info   `json:"ciphers"`
+  DefaultCipher int             `json:"default_cipher"`
+  FormatsRead   []int           `json:"formats_read"`
+  FormatsWrite  []int           `json:"formats_write"`
+  MinChunkSize  int             `json:"min_chunk_size"`
+  MaxChunkSize  int             `json:"max_chunk_size"`
+  MaxPayload    int64           `json:"max_payload_size"`
+  Features      map[string]bool `json:"features"`
+}
+
+var (
+  capabilities_once sync.Once
+  capabilities_json string
+)
+
+// capabilities returns JSON describing what this build supports: cipher ids
+// and names (as used by encrypt_with_cipher and detect_cipher), the one
+// picked by default on this machine, readable and writable format versions
+// (see inspect) and optional features. Needs no key and is computed once.
+// Caller must free_cstring the result
+//export capabilities
+func capabilities() *C.char {
+  clear_error()
+  defer count_export()
+  capabilities_once.Do(func() {
+    result, err := json.Marshal(capabilities_info{
+      Ciphers: []cipher_info{
+        {CIPHER_AES_GCM, cipher_names[CIPHER_AES_GCM]},
+        {CIPHER_CHACHA20, cipher_names[CIPHER_CHACHA20]},
+      },
+      DefaultCipher: aead_cipher(default_aead()),
+      FormatsRead:   []int{format_version},
+      FormatsWrite:  []int{format_version},
+      MinChunkSize:  min_chunk_size,
+      MaxChunkSize:  max_chunk_size,
+      MaxPayload:    max_payload,
+      Features: map[string]bool{
+        "aad":         true,
+        "base64":      true,
+        "batch":       true,
+        "chunked":     true,
+        "compression": true,
+        "file":        true,
+        "key_id":      true,
+        "parallel":    true,
+        "range":       true,
+        "streaming":   true,
+      },
+    })
+    if err == nil {
+      capabilities_json = string(result)
+    }
+  })
+  return C.CString(capabilities_json)
+}
+
+// max_payload_size returns the largest cleartext in bytes a single
+// ciphertext of default packages can hold. Larger input is refused with
+// STATUS_TOO_LARGE and has to be split over several objects
+//export max_payload_size
+func max_payload_size() C.longlong {
+  clear_error()
+  defer count_export()
+  return C.longlong(max_payload)
+}
+
+// Known-answer vectors for self_test, produced by madmin.EncryptData
+// compatible encryption under each cipher. They must decrypt with any
+// build of this library, changing them hides format incompatibilities
+var (
+  self_test_key        = []byte("pylon self test key")
+  self_test_cleartext  = []byte("pylon self test")
+  self_test_ciphertext = []string{
+    "f8f40a31dc89b1d781d81b9aa872aa4cf624d3f4f54ba272156ba5e31f1f5d8c00e9f67a7243f9cb257e8f8b76f472a0aae895ce53c57fb44413004c00f67b04338fba0dbc5daa18",
+    "28f6fa59da7f91cd6386c414ed578d473b9450f7c314679058d240cbed99855901feead7babaf9fe0092457c24f4909ebb9aa4a2b121b2a52f72c3bff4d3630af0e1ebaccdce50f4",
+  }
+)
+
+func self_test_data() int {
+  for _, id := range []byte{aead_aes_gcm, aead_c20p1305} {
+    ciphertext, status := encrypt_aead(self_test_key, self_test_cleartext, id, nil)
+    if status != STATUS_OK {
+      return status
+    }
+    cleartext, status := decrypt_raw(self_test_key, ciphertext)
+    if status != STATUS_OK {
+      return status
+    }
+    if !bytes.Equal(cleartext, self_test_cleartext) {
+      return fail(STATUS_INTERNAL, errors.New("round-trip cleartext mismatch"))
+    }
+  }
+  for _, vector := range self_test_ciphertext {
+    ciphertext, err := hex.DecodeString(vector)
+    if err != nil {
+      return fail(STATUS_INTERNAL, err)
+    }
+    cleartext, status := decrypt_raw(self_test_key, ciphertext)
+    if status != STATUS_OK {
+      return status
+    }
+    if !bytes.Equal(cleartext, self_test_cleartext) {
+      return fail(STATUS_INTERNAL, errors.New("known-answer cleartext mismatch"))
+    }
+  }
+  return STATUS_OK
+}
+
+// self_test runs an encrypt/decrypt round-trip under both ciphers and
+// decrypts fixed known-answer ciphertexts, returning STATUS_OK or the
+// STATUS_* of the first failure (see last_error). Meant to be called once
+// after loading the library to catch broken or incompatible builds
+//export self_test
+func self_test() C.int {
+  clear_error()
+  defer count_export()
+  return C.int(self_test_data())
+}
@@ -0,0 +1,75 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "encoding/hex"
+  "testing"
+)
+
+func TestSelfTestPasses(t *testing.T) {
+  if status := self_test(); status != STATUS_OK {
+    t.Fatalf("self_test gave %d: %s", status, test_take(last_error()))
+  }
+}
+
+// Encrypting the vector cleartext under the salt and nonce of a vector must
+// reproduce that vector byte for byte, under the cipher it names
+func TestSelfTestVectorsKnownAnswer(t *testing.T) {
+  if len(self_test_ciphertext) != 2 {
+    t.Fatalf("expected one vector per cipher, got %d", len(self_test_ciphertext))
+  }
+  for idx, vector := range self_test_ciphertext {
+    expected, err := hex.DecodeString(vector)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if id := []byte{aead_aes_gcm, aead_c20p1305}[idx]; expected[32] != id {
+      t.Fatalf("vector %d has AEAD ID %d, want %d", idx, expected[32], id)
+    }
+    var buffer bytes.Buffer
+    writer, err := encrypt_seeded_writer(self_test_key, &buffer, expected[32], nil, package_payload, expected[:32], expected[33:header_size])
+    if err != nil {
+      t.Fatal(err)
+    }
+    writer.Write(self_test_cleartext)
+    if err := writer.Close(); err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(buffer.Bytes(), expected) {
+      t.Fatalf("vector %d: encryption gave %x", idx, buffer.Bytes())
+    }
+    cleartext, status := decrypt_raw(self_test_key, expected)
+    if status != STATUS_OK || !bytes.Equal(cleartext, self_test_cleartext) {
+      t.Fatalf("vector %d: decrypted to %q, status %d", idx, cleartext, status)
+    }
+  }
+}
+
+func TestSelfTestVectorsRejectTampering(t *testing.T) {
+  for idx, vector := range self_test_ciphertext {
+    ciphertext, _ := hex.DecodeString(vector)
+    if _, status := decrypt_raw([]byte("another key"), ciphertext); status != STATUS_AUTH_FAILED {
+      t.Fatalf("vector %d: wrong key gave status %d", idx, status)
+    }
+    ciphertext[len(ciphertext) - 1] ^= 1
+    if _, status := decrypt_raw(self_test_key, ciphertext); status != STATUS_AUTH_FAILED {
+      t.Fatalf("vector %d: tampered tag gave status %d", idx, status)
+    }
+  }
+}
@@ -0,0 +1,184 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+)
+
+// madmin has a single ciphertext format so far. Its header carries no
+// version field, the number is assigned here for reporting purposes.
+// min_format_version is the oldest one upgrade_format still writes
+const (
+  format_version     = 1
+  min_format_version = 1
+)
+
+var cipher_names = map[int]string{
+  CIPHER_AES_GCM:  "AES-256-GCM",
+  CIPHER_CHACHA20: "ChaCha20-Poly1305",
+}
+
+type inspect_info struct {
+  FormatVersion int    `json:"format_version"`
+  Cipher        string `json:"cipher,omitempty"`
+  CipherID      int    `json:"cipher_id,omitempty"`
+  TagLength     int    `json:"tag_length,omitempty"`
+  PackageCount  int    `json:"package_count"`
+  TotalPayload  int64  `json:"total_payload"`
+  LastPackage   int    `json:"last_package"`
+  Parsed        int    `json:"parsed"`
+  Complete      bool   `json:"complete"`
+  Error         string `json:"error,omitempty"`
+}
+
+// inspect_data walks the ciphertext structure only, it never decrypts
+func inspect_data(ciphertext []byte) inspect_info {
+  return inspect_chunked(ciphertext, package_payload)
+}
+
+// inspect_chunked is inspect_data for chunk_size bytes packages
+func inspect_chunked(ciphertext []byte, chunk_size int) inspect_info {
+  info := inspect_info{FormatVersion: format_version}
+  if len(ciphertext) < header_size {
+    info.Parsed = len(ciphertext)
+    info.Error = "truncated header"
+    return info
+  }
+  if check_header(ciphertext) != STATUS_OK {
+    info.Parsed = 32
+    info.Error = "unknown AEAD algorithm ID"
+    return info
+  }
+  info.CipherID = aead_cipher(ciphertext[32])
+  info.Cipher = cipher_names[info.CipherID]
+  info.TagLength = package_overhead
+  info.Parsed = header_size
+  payload := len(ciphertext) - header_size
+  size := chunk_size + package_overhead
+  full, rest := payload / size, payload % size
+  info.PackageCount = full
+  info.Parsed += full * size
+  if full > 0 {
+    info.LastPackage = size
+  }
+  if rest >= package_overhead {
+    info.PackageCount++
+    info.Parsed += rest
+    info.LastPackage = rest
+  }
+  info.TotalPayload = int64(payload - info.PackageCount * package_overhead)
+  switch {
+  case info.PackageCount == 0:
+    info.Error = "no packages"
+  case info.Parsed != len(ciphertext):
+    info.Error = "truncated package"
+  default:
+    info.Complete = true
+  }
+  return info
+}
+
+// inspect returns JSON describing the ciphertext structure without
+// decrypting it, so no key is needed. Truncated input is reported with
+// "complete": false, "parsed" bytes and "error". "last_package" is the size
+// of the final package with its tag, one of a full package size may still
+// be cut on a package boundary, which only decrypt_ex can tell with the
+// key. Returns empty string on bad hex. Caller must free_cstring the result
+//export inspect
+func inspect(ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer count_export()
+  if c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  result, err := json.Marshal(inspect_data(ciphertext))
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
+
+// upgrade_format re-encrypts ciphertext into format target_version (0 for
+// the current one) under the same key, with fresh salt and nonce. Versions
+// outside min_format_version..format_version, including downgrades below
+// the minimum, report STATUS_UNSUPPORTED. Like rekey, the cleartext never
+// leaves Go. Caller must free_cstring the result
+//export upgrade_format
+func upgrade_format(secret_key *C.char, ciphertext_hex *C.char, target_version C.int, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("upgrade_format", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  version := int(target_version)
+  if version == 0 {
+    version = format_version
+  }
+  if version < min_format_version || version > format_version {
+    *status = C.int(fail(STATUS_UNSUPPORTED, errors.New("unsupported target format version")))
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, code := rekey_data(key, key, C.GoString(ciphertext_hex))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_tagcheck is decrypt_ex for callers expecting a given tag length
+// in bytes (0 for the format's). The madmin header has no tag length
+// field, both ciphers always use 16 byte tags, so any other tag_len and
+// a last package too short to hold a tag report STATUS_TAG_LENGTH.
+// Caller must free_cstring the result
+//export decrypt_tagcheck
+func decrypt_tagcheck(secret_key *C.char, ciphertext_hex *C.char, tag_len C.int, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_tagcheck", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  if tag_len != 0 && tag_len != package_overhead {
+    *status = C.int(fail(STATUS_TAG_LENGTH, errors.New("tag length differs from 16 bytes")))
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    *status = STATUS_BAD_HEX
+    return C.CString("")
+  }
+  if len(ciphertext) >= header_size {
+    payload := (len(ciphertext) - header_size) % package_size
+    if payload > 0 && payload < package_overhead {
+      *status = C.int(fail(STATUS_TAG_LENGTH, errors.New("last package shorter than a tag")))
+      return C.CString("")
+    }
+  }
+  data, code := decrypt_raw(key, ciphertext)
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
@@ -0,0 +1,58 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/json"
+  "strings"
+  "testing"
+)
+
+func TestDecryptTagcheckRejectsBadTagLength(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  // One full package then a 20 byte one holding 4 bytes and the tag
+  cleartext := test_cstring(strings.Repeat("ab", package_payload + 4))
+  defer test_free(cleartext)
+  ciphertext_hex := test_take(encrypt(key, cleartext))
+  ciphertext := test_cstring(ciphertext_hex)
+  defer test_free(ciphertext)
+  var info inspect_info
+  if err := json.Unmarshal([]byte(test_take(inspect(ciphertext))), &info); err != nil || info.TagLength != package_overhead {
+    t.Fatalf("inspect gave tag_length %d (%v)", info.TagLength, err)
+  }
+  status := test_new_int()
+  for _, tag_len := range []int{0, package_overhead} {
+    if result := test_take(decrypt_tagcheck(key, ciphertext, test_int(tag_len), status)); test_int_of(status) != STATUS_OK || result != test_gostring(cleartext) {
+      t.Fatalf("tag_len %d: status %d", tag_len, test_int_of(status))
+    }
+  }
+  for _, tag_len := range []int{-16, 1, 8, 12, 15, 17, 32} {
+    if result := test_take(decrypt_tagcheck(key, ciphertext, test_int(tag_len), status)); test_int_of(status) != STATUS_TAG_LENGTH || result != "" {
+      t.Errorf("tag_len %d: status %d, want %d", tag_len, test_int_of(status), STATUS_TAG_LENGTH)
+    }
+  }
+  // Cutting the last package to 1..15 bytes leaves no room for its tag
+  for left := 1; left < package_overhead; left++ {
+    cut := test_cstring(ciphertext_hex[:len(ciphertext_hex) - 2 * (4 + package_overhead - left)])
+    result := test_take(decrypt_tagcheck(key, cut, 0, status))
+    test_free(cut)
+    if test_int_of(status) != STATUS_TAG_LENGTH || result != "" {
+      t.Errorf("last package of %d bytes: status %d, want %d", left, test_int_of(status), STATUS_TAG_LENGTH)
+    }
+  }
+}
@@ -0,0 +1,109 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdint.h>
+import "C"
+import (
+  "context"
+  "errors"
+  "runtime"
+  "time"
+)
+
+// file_job is an encrypt_file running in the background. status and
+// message are only valid once done is closed
+type file_job struct {
+  cancel  context.CancelFunc
+  done    chan struct{}
+  status  int
+  message string
+}
+
+func is_file_job(value interface{}) bool {
+  _, ok := value.(*file_job)
+  return ok
+}
+
+// encrypt_file_start runs encrypt_file in the background and returns a job
+// handle, or 0 on failure. With timeout_ms above 0 the job is cancelled
+// after that many milliseconds. The handle must be released with
+// encrypt_file_wait, which also reports the outcome. The job is audited
+// when it finishes
+//export encrypt_file_start
+func encrypt_file_start(secret_key *C.char, in_path *C.char, out_path *C.char, timeout_ms C.longlong) C.uintptr_t {
+  clear_error()
+  call := audit_begin("encrypt_file_start", secret_key, c_path_size(in_path))
+  if c_no_key(secret_key) || c_null(in_path, out_path) {
+    call.end()
+    return 0
+  }
+  var ctx context.Context
+  var cancel context.CancelFunc
+  if timeout_ms > 0 {
+    ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout_ms) * time.Millisecond)
+  } else {
+    ctx, cancel = context.WithCancel(context.Background())
+  }
+  job := &file_job{cancel: cancel, done: make(chan struct{})}
+  key := c_secret(secret_key)
+  in, out := C.GoString(in_path), C.GoString(out_path)
+  go func() {
+    // Keep the thread for the whole job, so take_error finds its message
+    // and only that, whatever ran on the thread before
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    clear_error()
+    defer close(job.done)
+    defer cancel()
+    defer wipe(key)
+    job.status = encrypt_file_data(ctx, key, in, out, nil)
+    call.record(job.status)
+    job.message = take_error()
+  }()
+  return C.uintptr_t(handle_put(job))
+}
+
+// encrypt_cancel asks the job to stop, it then removes the partial output
+// and reports STATUS_CANCELLED from encrypt_file_wait. Returns STATUS_OK,
+// or STATUS_BAD_HANDLE for unknown handles. Does not release the handle
+//export encrypt_cancel
+func encrypt_cancel(handle C.uintptr_t) C.int {
+  clear_error()
+  defer count_export()
+  job, ok := handle_get(uintptr(handle)).(*file_job)
+  if !ok {
+    return C.int(fail(STATUS_BAD_HANDLE, errors.New("unknown job handle")))
+  }
+  job.cancel()
+  return STATUS_OK
+}
+
+// encrypt_file_wait blocks until the job is finished, releases the handle
+// and returns the STATUS_* of the job (see also last_error). The job was
+// counted with its audit record, so only an unknown handle counts here
+//export encrypt_file_wait
+func encrypt_file_wait(handle C.uintptr_t) C.int {
+  clear_error()
+  job, ok := handle_take(uintptr(handle), is_file_job).(*file_job)
+  if !ok {
+    return C.int(count_failure(fail(STATUS_BAD_HANDLE, errors.New("unknown job handle"))))
+  }
+  <-job.done
+  if job.status != STATUS_OK {
+    return C.int(fail(job.status, errors.New(job.message)))
+  }
+  return STATUS_OK
+}
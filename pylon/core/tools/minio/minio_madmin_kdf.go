@@ -0,0 +1,199 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "github.com/minio/minio/pkg/madmin"
+  "github.com/secure-io/sio-go"
+  "golang.org/x/crypto/argon2"
+  "golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation functions for decrypt_kdf
+const (
+  KDF_AUTO     = 0
+  KDF_ARGON2ID = 1
+  KDF_PBKDF2   = 2
+)
+
+// AEAD ID written by madmin-go FIPS builds, AES-GCM under a PBKDF2 key.
+// The PBKDF2-SHA256 cost is the one used there
+const (
+  aead_pbkdf2_aes_gcm = 0x02
+  pbkdf2_cost         = 8192
+)
+
+// kdf_key derives the stream key, the header AEAD ID decides the KDF
+// where it can, kdf_id is only honored for the Argon2id IDs
+func kdf_key(secret_key []byte, salt []byte, id byte, kdf_id int) ([]byte, int) {
+  switch {
+  case id == aead_pbkdf2_aes_gcm:
+    kdf_id = KDF_PBKDF2
+  case id != aead_aes_gcm && id != aead_c20p1305:
+    return nil, fail(STATUS_MALFORMED, errors.New("invalid AEAD algorithm ID"))
+  case kdf_id == KDF_AUTO:
+    kdf_id = KDF_ARGON2ID
+  }
+  return kdf_derive(secret_key, salt, kdf_id)
+}
+
+// kdf_derive runs KDF kdf_id, which must not be KDF_AUTO
+func kdf_derive(secret_key []byte, salt []byte, kdf_id int) ([]byte, int) {
+  switch kdf_id {
+  case KDF_ARGON2ID:
+    return argon2.IDKey(secret_key, salt, argon2_time, argon2_memory, argon2_threads, argon2_key_len), STATUS_OK
+  case KDF_PBKDF2:
+    return pbkdf2.Key(secret_key, salt, pbkdf2_cost, argon2_key_len, sha256.New), STATUS_OK
+  }
+  return nil, fail(STATUS_UNSUPPORTED, errors.New("unknown KDF id"))
+}
+
+func decrypt_kdf_data(secret_key []byte, ciphertext []byte, kdf_id int) ([]byte, int) {
+  if empty_ciphertext(ciphertext) {
+    return []byte{}, STATUS_OK
+  }
+  if len(ciphertext) < header_size {
+    return nil, fail(STATUS_MALFORMED, errors.New("ciphertext shorter than header"))
+  }
+  key, status := kdf_key(secret_key, ciphertext[:32], ciphertext[32], kdf_id)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  defer wipe(key)
+  return decrypt_derived(key, ciphertext)
+}
+
+// decrypt_derived decrypts with the stream key already derived, nothing
+// but authenticated cleartext is ever returned
+func decrypt_derived(key []byte, ciphertext []byte) ([]byte, int) {
+  aead, err := key_aead(key, ciphertext[32])
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  stream := sio.NewStream(aead, package_payload)
+  reader := stream.DecryptReader(bytes.NewReader(ciphertext[header_size:]), ciphertext[33:header_size], nil)
+  data, err := ioutil.ReadAll(reader)
+  if err == madmin.ErrMaliciousData {
+    wipe(data)
+    return nil, fail(STATUS_AUTH_FAILED, err)
+  }
+  if err != nil {
+    wipe(data)
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return data, STATUS_OK
+}
+
+// decrypt_auto_data tries the KDFs in the order documented at decrypt_auto
+// and returns the first cleartext that authenticates
+func decrypt_auto_data(secret_key []byte, ciphertext []byte) ([]byte, int) {
+  if empty_ciphertext(ciphertext) {
+    return []byte{}, STATUS_OK
+  }
+  if len(ciphertext) < header_size {
+    return nil, fail(STATUS_MALFORMED, errors.New("ciphertext shorter than header"))
+  }
+  order := []int{KDF_ARGON2ID, KDF_PBKDF2}
+  switch ciphertext[32] {
+  case aead_pbkdf2_aes_gcm:
+    order = []int{KDF_PBKDF2, KDF_ARGON2ID}
+  case aead_aes_gcm, aead_c20p1305:
+  default:
+    return nil, fail(STATUS_MALFORMED, errors.New("invalid AEAD algorithm ID"))
+  }
+  status := STATUS_AUTH_FAILED
+  for _, kdf_id := range order {
+    key, code := kdf_derive(secret_key, ciphertext[:32], kdf_id)
+    if code != STATUS_OK {
+      return nil, code
+    }
+    data, code := decrypt_derived(key, ciphertext)
+    wipe(key)
+    if code == STATUS_OK {
+      clear_error()
+      return data, STATUS_OK
+    }
+    if code != STATUS_AUTH_FAILED {
+      status = code
+    }
+  }
+  return nil, status
+}
+
+// decrypt_kdf is decrypt with a choice of key derivation. MinIO and
+// madmin have always written Argon2id ciphertexts (AEAD ID 0x00 or 0x01),
+// except FIPS builds of madmin-go (MinIO from 2021 on, built with the fips
+// tag) which write PBKDF2-SHA256 with AES-GCM under AEAD ID 0x02. That ID
+// is detected and always uses PBKDF2. For the other IDs kdf_id selects
+// 0 - auto (Argon2id), 1 - Argon2id or 2 - PBKDF2, the latter for blobs
+// from tools that kept the Argon2id ID with a PBKDF2 key.
+// Returns empty string on failure. Caller must free_cstring the result
+//export decrypt_kdf
+func decrypt_kdf(secret_key *C.char, ciphertext_hex *C.char, kdf_id C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_kdf", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := decrypt_kdf_data(key, ciphertext, int(kdf_id))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_auto is decrypt for ciphertexts of any MinIO generation. The
+// header AEAD ID fixes the cipher (0x00, 0x02 AES-256-GCM, 0x01
+// ChaCha20-Poly1305) and the KDFs are tried in this order:
+//   0x00, 0x01 - Argon2id as written by MinIO and madmin, then PBKDF2
+//                for tools that kept the ID with a PBKDF2 key
+//   0x02       - PBKDF2 as written by madmin-go FIPS builds, then Argon2id
+// The first authentic cleartext is returned, a wrong guess fails
+// authentication and its output is discarded. Each guess costs a full key
+// derivation, so a wrong secret key takes both. Returns empty string on
+// failure. Caller must free_cstring the result
+//export decrypt_auto
+func decrypt_auto(secret_key *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_auto", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := decrypt_auto_data(key, ciphertext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(hex.EncodeToString(data))
+}
@@ -0,0 +1,401 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "math"
+  "unicode"
+  "golang.org/x/crypto/argon2"
+)
+
+const (
+  default_key_length = 32
+  min_key_length     = 16
+  max_key_length     = 256
+  salt_length        = 16
+)
+
+// generate_secret_key returns length (default 32) random bytes from
+// crypto/rand as hex, or empty string if length is outside 16..256.
+// Caller must free_cstring the result
+//export generate_secret_key
+func generate_secret_key(length C.int) *C.char {
+  clear_error()
+  defer count_export()
+  size := int(length)
+  if size <= 0 {
+    size = default_key_length
+  }
+  if size < min_key_length || size > max_key_length {
+    fail(STATUS_BAD_ARG, errors.New("key length out of range"))
+    return C.CString("")
+  }
+  key := make([]byte, size)
+  if _, err := rand.Read(key); err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  defer wipe(key)
+  return C.CString(hex.EncodeToString(key))
+}
+
+// derive_key runs Argon2id with the madmin cost parameters (time 1,
+// memory 64 MiB, 4 threads) and returns key_len (default 32) bytes as hex.
+// If salt_hex is empty a random 16 byte salt is generated and returned
+// prepended to the key, i.e. salt_hex + key_hex. Returns empty string on
+// bad salt hex or key_len outside 16..256. Caller must free_cstring the result
+//export derive_key
+func derive_key(password *C.char, salt_hex *C.char, key_len C.int) *C.char {
+  clear_error()
+  defer audit_begin("derive_key", password, 0).end()
+  if c_no_key(password) {
+    return C.CString("")
+  }
+  size := int(key_len)
+  if size <= 0 {
+    size = argon2_key_len
+  }
+  if size < min_key_length || size > max_key_length {
+    fail(STATUS_BAD_ARG, errors.New("key length out of range"))
+    return C.CString("")
+  }
+  salt, err := decode_hex(C.GoString(salt_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  prefix := ""
+  if len(salt) == 0 {
+    salt = make([]byte, salt_length)
+    if _, err := rand.Read(salt); err != nil {
+      fail(STATUS_INTERNAL, err)
+      return C.CString("")
+    }
+    prefix = hex.EncodeToString(salt)
+  }
+  secret := c_secret(password)
+  defer wipe(secret)
+  key := argon2.IDKey(secret, salt, argon2_time, argon2_memory, argon2_threads, uint32(size))
+  defer wipe(key)
+  return C.CString(prefix + hex.EncodeToString(key))
+}
+
+func hmac_data(secret_key []byte, data []byte) []byte {
+  mac := hmac.New(sha256.New, secret_key)
+  mac.Write(data)
+  return mac.Sum(nil)
+}
+
+// hmac_sha256 returns hex HMAC-SHA256 of data keyed with secret_key, or
+// empty string on bad hex. Caller must free_cstring the result
+//export hmac_sha256
+func hmac_sha256(secret_key *C.char, data_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("hmac_sha256", secret_key, c_hex_size(data_hex)).end()
+  if c_no_key(secret_key) || c_null(data_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, err := decode_hex(C.GoString(data_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(hmac_data(key, data)))
+}
+
+// hmac_verify checks tag against HMAC-SHA256 of data in constant time.
+// Returns 1 if it matches, 0 if not, -STATUS_BAD_HEX on bad hex
+//export hmac_verify
+func hmac_verify(secret_key *C.char, data_hex *C.char, tag_hex *C.char) C.int {
+  clear_error()
+  defer audit_begin("hmac_verify", secret_key, c_hex_size(data_hex)).end()
+  if c_no_key(secret_key) || c_null(data_hex, tag_hex) {
+    return -STATUS_BAD_ARG
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, err := decode_hex(C.GoString(data_hex))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  tag, err := decode_hex(C.GoString(tag_hex))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  if hmac.Equal(hmac_data(key, data), tag) {
+    return 1
+  }
+  return 0
+}
+
+// secret_equal compares two hex encoded secrets in constant time. Returns
+// 1 if equal, 0 if not, -STATUS_BAD_HEX on bad hex. Only the length of
+// the secrets may leak through timing
+//export secret_equal
+func secret_equal(a *C.char, b *C.char) C.int {
+  clear_error()
+  defer count_export()
+  if c_null(a, b) {
+    return -STATUS_BAD_ARG
+  }
+  left, err := decode_hex(C.GoString(a))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  defer wipe(left)
+  right, err := decode_hex(C.GoString(b))
+  if err != nil {
+    return -STATUS_BAD_HEX
+  }
+  defer wipe(right)
+  return C.int(subtle.ConstantTimeCompare(left, right))
+}
+
+// read_key_file returns the whole key file and the key within it, without
+// the trailing newline. A file holding no key is refused, as c_no_key
+// does for an empty argument. Wipe the first one when done, also on failure
+func read_key_file(key_path *C.char) ([]byte, []byte, int) {
+  content, err := ioutil.ReadFile(C.GoString(key_path))
+  if err != nil {
+    return nil, nil, fail(STATUS_KEY_FILE, err)
+  }
+  key := content
+  if size := len(key); size > 0 && key[size - 1] == '\n' {
+    key = key[:size - 1]
+  }
+  if size := len(key); size > 0 && key[size - 1] == '\r' {
+    key = key[:size - 1]
+  }
+  if len(key) == 0 {
+    return content, nil, fail(STATUS_KEY_FILE, errors.New("key file holds an empty key"))
+  }
+  return content, key, STATUS_OK
+}
+
+// encrypt_keyfile is encrypt_ex reading the secret key from key_path, so it
+// never passes through the call arguments. STATUS_KEY_FILE is reported if
+// the file can not be read. Caller must free_cstring the result
+//export encrypt_keyfile
+func encrypt_keyfile(key_path *C.char, cleartext_hex *C.char, status *C.int) *C.char {
+  clear_error()
+  call := audit_begin("encrypt_keyfile", nil, c_hex_size(cleartext_hex))
+  defer call.end()
+  if c_null(key_path, cleartext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  content, key, code := read_key_file(key_path)
+  defer wipe(content)
+  if code != STATUS_OK {
+    *status = C.int(code)
+    return C.CString("")
+  }
+  call.key = fingerprint(key)
+  data, code := encrypt_data(key, C.GoString(cleartext_hex))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_keyfile is decrypt_ex reading the secret key from key_path,
+// see encrypt_keyfile. Caller must free_cstring the result
+//export decrypt_keyfile
+func decrypt_keyfile(key_path *C.char, ciphertext_hex *C.char, status *C.int) *C.char {
+  clear_error()
+  call := audit_begin("decrypt_keyfile", nil, c_hex_size(ciphertext_hex))
+  defer call.end()
+  if c_null(key_path, ciphertext_hex) || c_null_out(status) {
+    c_set(status, STATUS_BAD_ARG)
+    return C.CString("")
+  }
+  content, key, code := read_key_file(key_path)
+  defer wipe(content)
+  if code != STATUS_OK {
+    *status = C.int(code)
+    return C.CString("")
+  }
+  call.key = fingerprint(key)
+  data, code := decrypt_data(key, C.GoString(ciphertext_hex))
+  *status = C.int(code)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// Password strength policy of check_password_strength
+const (
+  min_password_length = 8
+  min_password_score  = 2
+)
+
+// password_score estimates entropy as length * log2(alphabet), the
+// alphabet being the union of the character classes used, and maps it to
+// 0 (below 28 bits), 1 (36), 2 (60), 3 (128) and 4. Passwords shorter than
+// min_password_length score 0 whatever their classes
+func password_score(password []byte) int {
+  runes := []rune(string(password))
+  if len(runes) < min_password_length {
+    return 0
+  }
+  var lower, upper, digit, other bool
+  for _, char := range runes {
+    switch {
+    case unicode.IsLower(char):
+      lower = true
+    case unicode.IsUpper(char):
+      upper = true
+    case unicode.IsDigit(char):
+      digit = true
+    default:
+      other = true
+    }
+  }
+  alphabet := 0
+  for _, class := range []struct {
+    used bool
+    size int
+  }{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+    if class.used {
+      alphabet += class.size
+    }
+  }
+  bits := float64(len(runes)) * math.Log2(float64(alphabet))
+  switch {
+  case bits < 28:
+    return 0
+  case bits < 36:
+    return 1
+  case bits < 60:
+    return 2
+  case bits < 128:
+    return 3
+  }
+  return 4
+}
+
+// check_password_strength scores a passphrase from 0 to 4, see
+// password_score. Scores below 2 mean weak and should be refused as a
+// secret key. Advisory only, the password is neither modified nor kept.
+// Returns -STATUS_BAD_ARG for NULL
+//export check_password_strength
+func check_password_strength(password *C.char) C.int {
+  clear_error()
+  defer count_export()
+  if c_null(password) {
+    return -STATUS_BAD_ARG
+  }
+  secret := c_secret(password)
+  defer wipe(secret)
+  return C.int(password_score(secret))
+}
+
+// Bytes of the SHA-256 of a key kept as its fingerprint
+const fingerprint_size = 8
+
+// fingerprint is the hex of the first fingerprint_size bytes of the
+// SHA-256 of secret_key, "" for no key
+func fingerprint(secret_key []byte) string {
+  if len(secret_key) == 0 {
+    return ""
+  }
+  sum := sha256.Sum256(secret_key)
+  defer wipe(sum[:])
+  return hex.EncodeToString(sum[:fingerprint_size])
+}
+
+// key_fingerprint returns a stable 16 hex digits fingerprint of the secret
+// key to tell keys apart in logs, the same one the audit log records.
+// It can not be reversed to the key, but it is a fast unsalted hash: a
+// guessable passphrase can be found from its fingerprint by trying
+// candidates, so only publish fingerprints of high entropy keys.
+// Returns empty string for NULL or empty keys. Caller must free_cstring the result
+//export key_fingerprint
+func key_fingerprint(secret_key *C.char) *C.char {
+  clear_error()
+  defer count_export()
+  if c_no_key(secret_key) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return C.CString(fingerprint(key))
+}
+
+// Wrapped keys bind wrap_key_aad, so a wrapped key does not decrypt as an
+// ordinary ciphertext and an ordinary ciphertext does not unwrap
+var wrap_key_aad = []byte("pylon wrapped key")
+
+// wrap_key encrypts the 32 byte hex data key under master_key for
+// envelope encryption (e.g. for use with encrypt_rawkey). data_key_hex of
+// any other length is refused with STATUS_BAD_ARG. Returns empty string on
+// failure. Caller must free_cstring the result
+//export wrap_key
+func wrap_key(master_key *C.char, data_key_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("wrap_key", master_key, c_hex_size(data_key_hex)).end()
+  if c_no_key(master_key) || c_null(data_key_hex) {
+    return C.CString("")
+  }
+  data_key, err := decode_hex(C.GoString(data_key_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(data_key)
+  if len(data_key) != raw_key_length {
+    fail(STATUS_BAD_ARG, errors.New("data key must be 32 bytes"))
+    return C.CString("")
+  }
+  key := c_secret(master_key)
+  defer wipe(key)
+  data, status := encrypt_aead(key, data_key, default_aead(), wrap_key_aad)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// unwrap_key reverses wrap_key and returns the hex data key. A wrong
+// master key fails authentication, anything that does not unwrap to a
+// 32 byte key is refused. Returns empty string on failure.
+// Caller must free_cstring the result
+//export unwrap_key
+func unwrap_key(master_key *C.char, wrapped_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("unwrap_key", master_key, c_hex_size(wrapped_hex)).end()
+  if c_no_key(master_key) || c_null(wrapped_hex) {
+    return C.CString("")
+  }
+  wrapped, err := decode_hex(C.GoString(wrapped_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  key := c_secret(master_key)
+  defer wipe(key)
+  data_key, status := decrypt_aead(key, wrapped, wrap_key_aad)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data_key)
+  if len(data_key) != raw_key_length {
+    fail(STATUS_MALFORMED, errors.New("wrapped value is not a 32 byte key"))
+    return C.CString("")
+  }
+  return c_hex(data_key)
+}
@@ -0,0 +1,132 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestSecretEqual(t *testing.T) {
+  cases := []struct {
+    a, b  string
+    equal int
+  }{
+    {"", "", 1},
+    {"00", "00", 1},
+    {"deadbeef", "DEADBEEF", 1},
+    {"deadbeef\n", "deadbeef", 1},
+    {"deadbeef", "deadbeee", 0},
+    {"deadbeef", "deadbe", 0},
+    {"deadbe", "deadbeef", 0},
+    {"", "00", 0},
+    {"00112233445566778899aabbccddeeff", "00112233445566778899aabbccddeefe", 0},
+    {"001", "001", -STATUS_BAD_HEX},
+    {"00", "zz", -STATUS_BAD_HEX},
+  }
+  for _, test := range cases {
+    a, b := test_cstring(test.a), test_cstring(test.b)
+    if result := int(secret_equal(a, b)); result != test.equal {
+      t.Errorf("secret_equal(%q, %q) = %d, want %d", test.a, test.b, result, test.equal)
+    }
+    test_free(a)
+    test_free(b)
+  }
+  if result := secret_equal(nil, nil); result != -STATUS_BAD_ARG {
+    t.Errorf("secret_equal(NULL, NULL) = %d", result)
+  }
+}
+
+func TestWrapKeyRoundTrip(t *testing.T) {
+  master := test_cstring(test_key)
+  defer test_free(master)
+  data_key_hex := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+  data_key := test_cstring(data_key_hex)
+  defer test_free(data_key)
+  wrapped_hex := test_take(wrap_key(master, data_key))
+  if wrapped_hex == "" {
+    t.Fatalf("wrap_key: %s", test_take(last_error()))
+  }
+  if again := test_take(wrap_key(master, data_key)); again == wrapped_hex {
+    t.Error("wrapping twice gave the same ciphertext")
+  }
+  wrapped := test_cstring(wrapped_hex)
+  defer test_free(wrapped)
+  if unwrapped := test_take(unwrap_key(master, wrapped)); unwrapped != data_key_hex {
+    t.Fatalf("unwrap_key gave %q: %s", unwrapped, test_take(last_error()))
+  }
+  // The AAD keeps wrapped keys and ordinary ciphertexts apart
+  if result := test_take(decrypt(master, wrapped)); result != "" {
+    t.Error("wrapped key decrypted as an ordinary ciphertext")
+  }
+  ordinary := test_cstring(test_take(encrypt(master, data_key)))
+  defer test_free(ordinary)
+  if result := test_take(unwrap_key(master, ordinary)); result != "" {
+    t.Error("ordinary ciphertext unwrapped")
+  }
+  short := test_cstring(data_key_hex[2:])
+  defer test_free(short)
+  if result := test_take(wrap_key(master, short)); result != "" {
+    t.Error("31 byte data key wrapped")
+  }
+}
+
+func TestUnwrapKeyWrongMasterKey(t *testing.T) {
+  master := test_cstring(test_key)
+  defer test_free(master)
+  data_key := test_cstring(strings.Repeat("a7", raw_key_length))
+  defer test_free(data_key)
+  wrapped := test_cstring(test_take(wrap_key(master, data_key)))
+  defer test_free(wrapped)
+  for _, other := range []string{test_key + "!", "MINIOADMIN", test_key[1:]} {
+    wrong := test_cstring(other)
+    result := test_take(unwrap_key(wrong, wrapped))
+    message := test_take(last_error())
+    test_free(wrong)
+    if result != "" || message == "" {
+      t.Errorf("master key %q: unwrapped %q, last_error %q", other, result, message)
+    }
+  }
+}
+
+func TestKeyFileRejectsEmptyKey(t *testing.T) {
+  dir, err := ioutil.TempDir("", "pylon-keyfile")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  cleartext := test_cstring("00ff")
+  defer test_free(cleartext)
+  status := test_new_int()
+  for _, content := range []string{"", "\n", "\r\n"} {
+    path := filepath.Join(dir, "key")
+    if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+      t.Fatal(err)
+    }
+    key_path := test_cstring(path)
+    if result := test_take(encrypt_keyfile(key_path, cleartext, status)); result != "" || test_int_of(status) != STATUS_KEY_FILE {
+      t.Errorf("encrypt_keyfile with %q: status %d, want %d", content, test_int_of(status), STATUS_KEY_FILE)
+    }
+    if result := test_take(decrypt_keyfile(key_path, cleartext, status)); result != "" || test_int_of(status) != STATUS_KEY_FILE {
+      t.Errorf("decrypt_keyfile with %q: status %d, want %d", content, test_int_of(status), STATUS_KEY_FILE)
+    }
+    test_free(key_path)
+  }
+}
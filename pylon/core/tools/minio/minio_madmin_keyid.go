@@ -0,0 +1,125 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "encoding/hex"
+  "errors"
+)
+
+// Key id ciphertext layout: magic (3) | id length (1) | id | madmin ciphertext.
+// The madmin ciphertext after the marker is a plain one, decrypt and madmin
+// read it as is. The id is not authenticated, a swapped id only selects a
+// key under which the ciphertext then fails authentication
+var keyid_magic = []byte("KID")
+
+const max_keyid_length = 255
+
+// split_keyid returns the marker and the madmin ciphertext following it
+func split_keyid(ciphertext []byte) ([]byte, []byte, int) {
+  prefix := len(keyid_magic) + 1
+  if len(ciphertext) < prefix || !bytes.Equal(ciphertext[:len(keyid_magic)], keyid_magic) {
+    return nil, nil, fail(STATUS_MALFORMED, errors.New("missing key id marker"))
+  }
+  end := prefix + int(ciphertext[prefix - 1])
+  if len(ciphertext) < end {
+    return nil, nil, fail(STATUS_MALFORMED, errors.New("truncated key id"))
+  }
+  return ciphertext[:end], ciphertext[end:], STATUS_OK
+}
+
+// encrypt_with_keyid is encrypt storing key_id (1 to 255 bytes) in front
+// of the ciphertext, to be read back with read_keyid before choosing the
+// key. Decrypt with decrypt_with_keyid, or strip the marker and decrypt.
+// Returns empty string on failure. Caller must free_cstring the result
+//export encrypt_with_keyid
+func encrypt_with_keyid(secret_key *C.char, cleartext_hex *C.char, key_id *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_with_keyid", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex, key_id) {
+    return C.CString("")
+  }
+  id := C.GoString(key_id)
+  if len(id) == 0 || len(id) > max_keyid_length {
+    fail(STATUS_BAD_ARG, errors.New("key id must be 1 to 255 bytes"))
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  marker := append(append(append([]byte{}, keyid_magic...), byte(len(id))), id...)
+  data, status := encrypt_raw(key, cleartext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(append(marker, data...)))
+}
+
+// decrypt_with_keyid strips the key id marker and decrypts the rest,
+// caller must free_cstring the result
+//export decrypt_with_keyid
+func decrypt_with_keyid(secret_key *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_with_keyid", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  if empty_ciphertext(ciphertext) {
+    return C.CString("")
+  }
+  _, rest, status := split_keyid(ciphertext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  data, status := decrypt_raw(key, rest)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(hex.EncodeToString(data))
+}
+
+// read_keyid returns the key id of an encrypt_with_keyid ciphertext without
+// needing the key, or empty string if there is none. The id is not
+// authenticated, decrypting with the key it names is what proves it.
+// Caller must free_cstring the result
+//export read_keyid
+func read_keyid(ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer count_export()
+  if c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  marker, _, status := split_keyid(ciphertext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(string(marker[len(keyid_magic) + 1:]))
+}
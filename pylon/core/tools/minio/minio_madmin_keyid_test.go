@@ -0,0 +1,72 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/hex"
+  "testing"
+)
+
+func TestKeyidMarkerWrapsPlainCiphertext(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring("c0ffee")
+  defer test_free(cleartext)
+  key_id := test_cstring("tenant-1/2020")
+  defer test_free(key_id)
+  blob := test_cstring(test_take(encrypt_with_keyid(key, cleartext, key_id)))
+  defer test_free(blob)
+  if id := test_take(read_keyid(blob)); id != "tenant-1/2020" {
+    t.Fatalf("read_keyid gave %q", id)
+  }
+  if result := test_take(decrypt_with_keyid(key, blob)); result != "c0ffee" {
+    t.Fatalf("decrypt_with_keyid gave %q", result)
+  }
+  // Stripping magic, length and id leaves what plain decrypt takes
+  marker := hex.EncodeToString(append(append([]byte("KID"), 13), "tenant-1/2020"...))
+  blob_hex := test_gostring(blob)
+  if blob_hex[:len(marker)] != marker {
+    t.Fatalf("unexpected marker in %q", blob_hex)
+  }
+  inner := test_cstring(blob_hex[len(marker):])
+  defer test_free(inner)
+  if result := test_take(decrypt(key, inner)); result != "c0ffee" {
+    t.Fatalf("plain decrypt of the stripped blob gave %q", result)
+  }
+  if result := test_take(decrypt(key, blob)); result != "" {
+    t.Fatalf("plain decrypt accepted the marker, gave %q", result)
+  }
+}
+
+func TestKeyidRejectsBadInput(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring("00")
+  defer test_free(cleartext)
+  empty := test_cstring("")
+  defer test_free(empty)
+  if result := test_take(encrypt_with_keyid(key, cleartext, empty)); result != "" || test_take(last_error()) == "" {
+    t.Fatalf("empty key id gave %q", result)
+  }
+  for _, blob_hex := range []string{"", "4b4944", "4b49440574656e"} {
+    blob := test_cstring(blob_hex)
+    if id := test_take(read_keyid(blob)); id != "" {
+      t.Errorf("read_keyid(%q) gave %q", blob_hex, id)
+    }
+    test_free(blob)
+  }
+}
@@ -0,0 +1,207 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/json"
+  "sync/atomic"
+)
+
+// Aggregate operation counters for scraping. They are updated together with
+// the audit log but with sync/atomic only, so hot paths take no lock
+
+var (
+  metrics_encrypt_calls int64
+  metrics_decrypt_calls int64
+  metrics_encrypt_bytes int64
+  metrics_decrypt_bytes int64
+  metrics_failures      [len(status_names)]int64
+)
+
+// status_names are the metrics labels of the STATUS_* values
+var status_names = [...]string{
+  "ok", "bad_hex", "auth_failed", "malformed", "internal", "io_error",
+  "unsupported", "buffer_small", "out_of_range", "too_large", "key_file",
+  "cancelled", "bad_arg", "tag_length", "wrong_key", "corrupt", "truncated",
+  "bad_handle",
+}
+
+type metrics_snapshot struct {
+  EncryptCalls int64            `json:"encrypt_calls"`
+  DecryptCalls int64            `json:"decrypt_calls"`
+  EncryptBytes int64            `json:"encrypt_bytes"`
+  DecryptBytes int64            `json:"decrypt_bytes"`
+  Failures     map[string]int64 `json:"failures"`
+}
+
+// Operation kinds of the audited exports for the counters. Every audited
+// operation is listed, those neither encrypting nor decrypting a payload
+// (chain_init, derive_key, hmac_*) with 0 so that only their failures are
+// counted. Re-encryptions count as both a decrypt and an encrypt
+const (
+  operation_encrypt = 1 << iota
+  operation_decrypt
+)
+
+var operation_kinds = map[string]int{
+  "encrypt":               operation_encrypt,
+  "encrypt_aad":           operation_encrypt,
+  "encrypt_base64":        operation_encrypt,
+  "encrypt_batch":         operation_encrypt,
+  "encrypt_bytes":         operation_encrypt,
+  "encrypt_chunked":       operation_encrypt,
+  "encrypt_compressed":    operation_encrypt,
+  "encrypt_ex":            operation_encrypt,
+  "encrypt_file":          operation_encrypt,
+  "encrypt_file_progress": operation_encrypt,
+  "encrypt_file_start":    operation_encrypt,
+  "encrypt_hex_case":      operation_encrypt,
+  "encrypt_keyfile":       operation_encrypt,
+  "encrypt_multi":         operation_encrypt,
+  "encrypt_opts":          operation_encrypt,
+  "encrypt_parallel":      operation_encrypt,
+  "encrypt_rawkey":        operation_encrypt,
+  "encrypt_result":        operation_encrypt,
+  "encrypt_stream":        operation_encrypt,
+  "encrypt_text":          operation_encrypt,
+  "encrypt_with_cipher":   operation_encrypt,
+  "encrypt_with_crc":      operation_encrypt,
+  "encrypt_with_entropy":  operation_encrypt,
+  "encrypt_with_hash":     operation_encrypt,
+  "encrypt_with_keyid":    operation_encrypt,
+  "chain_append":          operation_encrypt,
+  "wrap_key":              operation_encrypt,
+
+  "decrypt":               operation_decrypt,
+  "decrypt_aad":           operation_decrypt,
+  "decrypt_archive":       operation_decrypt,
+  "decrypt_auto":          operation_decrypt,
+  "decrypt_base64":        operation_decrypt,
+  "decrypt_batch":         operation_decrypt,
+  "decrypt_best_effort":   operation_decrypt,
+  "decrypt_bytes":         operation_decrypt,
+  "decrypt_capped":        operation_decrypt,
+  "decrypt_chunked":       operation_decrypt,
+  "decrypt_compressed":    operation_decrypt,
+  "decrypt_ex":            operation_decrypt,
+  "decrypt_file":          operation_decrypt,
+  "decrypt_from_fd":       operation_decrypt,
+  "decrypt_hardened":      operation_decrypt,
+  "decrypt_into":          operation_decrypt,
+  "decrypt_kdf":           operation_decrypt,
+  "decrypt_keyfile":       operation_decrypt,
+  "decrypt_opts":          operation_decrypt,
+  "decrypt_range":         operation_decrypt,
+  "decrypt_range_chunked": operation_decrypt,
+  "decrypt_rawkey":        operation_decrypt,
+  "decrypt_result":        operation_decrypt,
+  "decrypt_stream":        operation_decrypt,
+  "decrypt_tagcheck":      operation_decrypt,
+  "decrypt_text":          operation_decrypt,
+  "decrypt_to_addr":       operation_decrypt,
+  "decrypt_to_fd":         operation_decrypt,
+  "decrypt_wipe":          operation_decrypt,
+  "decrypt_with_crc":      operation_decrypt,
+  "decrypt_with_keyid":    operation_decrypt,
+  "can_decrypt":           operation_decrypt,
+  "chain_verify":          operation_decrypt,
+  "unwrap_key":            operation_decrypt,
+  "verify":                operation_decrypt,
+
+  "rekey":                 operation_encrypt | operation_decrypt,
+  "rekey_ex":              operation_encrypt | operation_decrypt,
+  "rekey_file":            operation_encrypt | operation_decrypt,
+  "rekey_verified":        operation_encrypt | operation_decrypt,
+  "upgrade_format":        operation_encrypt | operation_decrypt,
+
+  "chain_init":            0,
+  "derive_key":            0,
+  "hmac_sha256":           0,
+  "hmac_verify":           0,
+}
+
+// count_operation adds an audited operation to the counters by its kind
+func count_operation(operation string, status int, size int64) {
+  kind := operation_kinds[operation]
+  if kind & operation_encrypt != 0 {
+    atomic.AddInt64(&metrics_encrypt_calls, 1)
+    atomic.AddInt64(&metrics_encrypt_bytes, size)
+  }
+  if kind & operation_decrypt != 0 {
+    atomic.AddInt64(&metrics_decrypt_calls, 1)
+    atomic.AddInt64(&metrics_decrypt_bytes, size)
+  }
+  count_failure(status)
+}
+
+// count_failure adds status to the failure counters, for exports that are
+// not audited, and returns it unchanged
+func count_failure(status int) int {
+  if status > STATUS_OK && status < len(metrics_failures) {
+    atomic.AddInt64(&metrics_failures[status], 1)
+  }
+  return status
+}
+
+// count_export counts the status the current thread failed with. Exports
+// that are not audited defer it right after clear_error, so every return
+// path is counted, argument checks included
+func count_export() {
+  count_failure(thread_status())
+}
+
+// metrics_read loads a counter, or swaps it with 0 when resetting
+func metrics_read(counter *int64, reset bool) int64 {
+  if reset {
+    return atomic.SwapInt64(counter, 0)
+  }
+  return atomic.LoadInt64(counter)
+}
+
+// metrics_reset sets every counter back to 0
+func metrics_reset() {
+  for _, counter := range []*int64{&metrics_encrypt_calls, &metrics_decrypt_calls, &metrics_encrypt_bytes, &metrics_decrypt_bytes} {
+    atomic.StoreInt64(counter, 0)
+  }
+  for status := range metrics_failures {
+    atomic.StoreInt64(&metrics_failures[status], 0)
+  }
+}
+
+// metrics returns the operation counters as JSON, failures keyed by status
+// name. Non-zero reset clears every counter as it is read, for delta
+// scraping. Caller must free_cstring the result
+//export metrics
+func metrics(reset C.int) *C.char {
+  clear_error()
+  defer count_export()
+  snapshot := metrics_snapshot{
+    EncryptCalls: metrics_read(&metrics_encrypt_calls, reset != 0),
+    DecryptCalls: metrics_read(&metrics_decrypt_calls, reset != 0),
+    EncryptBytes: metrics_read(&metrics_encrypt_bytes, reset != 0),
+    DecryptBytes: metrics_read(&metrics_decrypt_bytes, reset != 0),
+    Failures:     map[string]int64{},
+  }
+  for status := STATUS_OK + 1; status < len(metrics_failures); status++ {
+    snapshot.Failures[status_names[status]] = metrics_read(&metrics_failures[status], reset != 0)
+  }
+  result, err := json.Marshal(snapshot)
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
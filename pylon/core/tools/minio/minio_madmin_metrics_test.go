@@ -0,0 +1,120 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "testing"
+)
+
+func read_metrics(t *testing.T, reset bool) metrics_snapshot {
+  flag := 0
+  if reset {
+    flag = 1
+  }
+  var snapshot metrics_snapshot
+  if err := json.Unmarshal([]byte(test_take(metrics(test_int(flag)))), &snapshot); err != nil {
+    t.Fatal(err)
+  }
+  return snapshot
+}
+
+func TestMetricsCountEarlyFailures(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  bad_hex := test_cstring("zz")
+  defer test_free(bad_hex)
+  read_metrics(t, true)
+  free_cstring(decrypt(key, bad_hex))
+  free_cstring(encrypt(nil, bad_hex))
+  free_cstring(inspect(bad_hex))
+  free_cstring(derive_key(key, nil, 1))
+  detect_cipher(nil)
+  free_cstring(decrypt_stream_update(0, nil, 0, nil))
+  snapshot := read_metrics(t, true)
+  if snapshot.DecryptCalls != 1 || snapshot.EncryptCalls != 1 || snapshot.DecryptBytes != 1 {
+    t.Errorf("calls and bytes not counted: %+v", snapshot)
+  }
+  if snapshot.Failures["bad_hex"] != 2 || snapshot.Failures["bad_arg"] != 4 {
+    t.Errorf("early failures not counted: %+v", snapshot.Failures)
+  }
+  if snapshot = read_metrics(t, false); snapshot.Failures["bad_hex"] != 0 || snapshot.DecryptCalls != 0 {
+    t.Errorf("reset left %+v", snapshot)
+  }
+}
+
+func TestMetricsClassifyEveryAuditedOperation(t *testing.T) {
+  sources, err := filepath.Glob("*.go")
+  if err != nil {
+    t.Fatal(err)
+  }
+  operation := regexp.MustCompile(`audit_begin\("([a-z0-9_]+)"`)
+  for _, source := range sources {
+    if strings.HasSuffix(source, "_test.go") {
+      continue
+    }
+    code, err := ioutil.ReadFile(source)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, match := range operation.FindAllSubmatch(code, -1) {
+      if _, ok := operation_kinds[string(match[1])]; !ok {
+        t.Errorf("%s: operation %s has no kind", source, match[1])
+      }
+    }
+  }
+}
+
+func TestMetricsCountOperationKinds(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring("c0ffee")
+  defer test_free(cleartext)
+  ciphertext := test_cstring(test_take(encrypt(key, cleartext)))
+  defer test_free(ciphertext)
+  data_key := test_cstring(strings.Repeat("ab", 32))
+  defer test_free(data_key)
+  status := test_new_int()
+  read_metrics(t, true)
+  verify(key, ciphertext)
+  can_decrypt(key, ciphertext)
+  free_cstring(upgrade_format(key, ciphertext, 0, status))
+  wrapped := test_cstring(test_take(wrap_key(key, data_key)))
+  defer test_free(wrapped)
+  free_cstring(unwrap_key(key, wrapped))
+  chain := chain_init(key)
+  records := test_cstring(`["` + test_take(chain_append(chain, cleartext)) + `"]`)
+  defer test_free(records)
+  chain_free(chain)
+  chain_verify(key, records)
+  free_cstring(hmac_sha256(key, cleartext))
+  // upgrade_format, wrap_key and chain_append encrypt, upgrade_format,
+  // verify, can_decrypt, unwrap_key and chain_verify decrypt
+  snapshot := read_metrics(t, true)
+  if snapshot.EncryptCalls != 3 || snapshot.DecryptCalls != 5 {
+    t.Errorf("operations counted as %d encrypts, %d decrypts", snapshot.EncryptCalls, snapshot.DecryptCalls)
+  }
+  for name, count := range snapshot.Failures {
+    if count != 0 {
+      t.Errorf("%d %s failures", count, name)
+    }
+  }
+}
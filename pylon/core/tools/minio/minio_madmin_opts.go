@@ -0,0 +1,210 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "github.com/minio/minio/pkg/madmin"
+  "github.com/secure-io/sio-go"
+  "github.com/secure-io/sio-go/sioutil"
+)
+
+// crypt_options combine the knobs of the narrow exports, zero values
+// meaning their defaults. cipher and kdf take the CIPHER_* and KDF_* ids,
+// chunk_size is the one of encrypt_chunked, compress that of
+// encrypt_compressed and aad that of encrypt_aad. With strict set unknown
+// keys are an error instead of being ignored
+type crypt_options struct {
+  Cipher    int    `json:"cipher"`
+  KDF       int    `json:"kdf"`
+  ChunkSize int    `json:"chunk_size"`
+  Compress  bool   `json:"compress"`
+  AAD       string `json:"aad"`
+  Strict    bool   `json:"strict"`
+}
+
+// parse_options reads options_json, empty meaning all defaults, and
+// validates the values. Problems are recorded as STATUS_BAD_ARG
+func parse_options(options_json string) (crypt_options, int) {
+  var options crypt_options
+  if options_json == "" {
+    options_json = "{}"
+  }
+  if err := json.Unmarshal([]byte(options_json), &options); err != nil {
+    return options, fail(STATUS_BAD_ARG, fmt.Errorf("invalid options: %v", err))
+  }
+  if options.Strict {
+    decoder := json.NewDecoder(bytes.NewReader([]byte(options_json)))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&crypt_options{}); err != nil {
+      return options, fail(STATUS_BAD_ARG, fmt.Errorf("invalid options: %v", err))
+    }
+  }
+  if _, ok := cipher_aead(options.Cipher); !ok {
+    return options, fail(STATUS_BAD_ARG, fmt.Errorf("invalid options: unknown cipher %d", options.Cipher))
+  }
+  if options.KDF < KDF_AUTO || options.KDF > KDF_PBKDF2 {
+    return options, fail(STATUS_BAD_ARG, fmt.Errorf("invalid options: unknown kdf %d", options.KDF))
+  }
+  if options.KDF == KDF_PBKDF2 && options.Cipher == CIPHER_CHACHA20 {
+    return options, fail(STATUS_BAD_ARG, errors.New("invalid options: kdf 2 (PBKDF2) needs cipher AES-256-GCM"))
+  }
+  if options.ChunkSize < 0 || options.ChunkSize > max_chunk_size {
+    return options, fail(STATUS_BAD_ARG, fmt.Errorf("invalid options: chunk_size outside 0..%d", max_chunk_size))
+  }
+  if options.ChunkSize == 0 {
+    options.ChunkSize = package_payload
+  }
+  return options, STATUS_OK
+}
+
+// encrypt_opts_data encrypts as the options say. PBKDF2 is written the
+// madmin-go FIPS way, AES-GCM under AEAD ID 0x02
+func encrypt_opts_data(secret_key []byte, cleartext []byte, options crypt_options) ([]byte, int) {
+  id, _ := cipher_aead(options.Cipher)
+  if options.KDF == KDF_PBKDF2 {
+    id = aead_pbkdf2_aes_gcm
+  }
+  if options.Compress {
+    cleartext = compress_data(cleartext)
+    defer wipe(cleartext)
+  }
+  salt := sioutil.MustRandom(32)
+  key, status := kdf_key(secret_key, salt, id, options.KDF)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  defer wipe(key)
+  aead, err := key_aead(key, id)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  var buffer bytes.Buffer
+  writer, err := stream_writer(sio.NewStream(aead, options.ChunkSize), &buffer, id, []byte(options.AAD), salt, sioutil.MustRandom(8))
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if _, err := writer.Write(cleartext); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if err := writer.Close(); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+// decrypt_opts_data reverses encrypt_opts_data, the cipher comes from the
+// header and the cipher option is ignored
+func decrypt_opts_data(secret_key []byte, ciphertext []byte, options crypt_options) ([]byte, int) {
+  if empty_ciphertext(ciphertext) {
+    return []byte{}, STATUS_OK
+  }
+  if len(ciphertext) < header_size {
+    return nil, fail(STATUS_MALFORMED, errors.New("ciphertext shorter than header"))
+  }
+  key, status := kdf_key(secret_key, ciphertext[:32], ciphertext[32], options.KDF)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  defer wipe(key)
+  aead, err := key_aead(key, ciphertext[32])
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  stream := sio.NewStream(aead, options.ChunkSize)
+  reader := stream.DecryptReader(bytes.NewReader(ciphertext[header_size:]), ciphertext[33:header_size], []byte(options.AAD))
+  data, err := ioutil.ReadAll(reader)
+  if err == madmin.ErrMaliciousData {
+    wipe(data)
+    return nil, fail(STATUS_AUTH_FAILED, err)
+  }
+  if err != nil {
+    wipe(data)
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if !options.Compress {
+    return data, STATUS_OK
+  }
+  defer wipe(data)
+  cleartext, status := decompress_data(data)
+  if status != STATUS_OK {
+    return nil, fail(status, errors.New("invalid compressed cleartext"))
+  }
+  defer wipe(cleartext)
+  return append([]byte{}, cleartext...), STATUS_OK
+}
+
+// encrypt_opts is encrypt configured by a JSON object with the keys
+// "cipher", "kdf", "chunk_size", "compress", "aad" and "strict", see
+// crypt_options. Invalid options are described by last_error. A ciphertext
+// with any non-default option needs decrypt_opts with the same options.
+// Returns empty string on failure. Caller must free_cstring the result
+//export encrypt_opts
+func encrypt_opts(secret_key *C.char, cleartext_hex *C.char, options_json *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_opts", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) {
+    return C.CString("")
+  }
+  options, status := parse_options(C.GoString(options_json))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(cleartext)
+  data, status := encrypt_opts_data(key, cleartext, options)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_opts is the decrypt counterpart of encrypt_opts,
+// caller must free_cstring the result
+//export decrypt_opts
+func decrypt_opts(secret_key *C.char, ciphertext_hex *C.char, options_json *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_opts", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  options, status := parse_options(C.GoString(options_json))
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := decrypt_opts_data(key, ciphertext, options)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(hex.EncodeToString(data))
+}
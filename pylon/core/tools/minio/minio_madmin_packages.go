@@ -0,0 +1,121 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+)
+
+// split_data cuts a complete ciphertext into the header followed by its
+// packages, without decrypting
+func split_data(ciphertext []byte) ([][]byte, int) {
+  info := inspect_data(ciphertext)
+  if !info.Complete {
+    return nil, fail(STATUS_MALFORMED, errors.New(info.Error))
+  }
+  parts := [][]byte{ciphertext[:header_size]}
+  for offset := header_size; offset < len(ciphertext); offset += package_size {
+    end := offset + package_size
+    if end > len(ciphertext) {
+      end = len(ciphertext)
+    }
+    parts = append(parts, ciphertext[offset:end])
+  }
+  return parts, STATUS_OK
+}
+
+// join_data reverses split_data, checking every part sits on a package
+// boundary: all full packages but the last, which holds at least a tag
+func join_data(parts [][]byte) ([]byte, int) {
+  if len(parts) < 2 {
+    return nil, fail(STATUS_MALFORMED, errors.New("header and at least one package needed"))
+  }
+  if len(parts[0]) != header_size || check_header(parts[0]) != STATUS_OK {
+    return nil, fail(STATUS_MALFORMED, errors.New("first part is not a header"))
+  }
+  var result []byte
+  for idx, part := range parts {
+    last := idx == len(parts) - 1
+    if idx > 0 && (len(part) > package_size || len(part) < package_overhead || !last && len(part) != package_size) {
+      return nil, fail(STATUS_MALFORMED, errors.New("part is not a whole package"))
+    }
+    result = append(result, part...)
+  }
+  return result, STATUS_OK
+}
+
+// split_packages returns a JSON array of hex strings: the 41 byte header
+// followed by one item per DARE package, e.g. to shard a ciphertext.
+// Nothing is decrypted, so no key is needed. Returns empty string on bad
+// hex or incomplete ciphertext. Caller must free_cstring the result
+//export split_packages
+func split_packages(ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer count_export()
+  if c_null(ciphertext_hex) {
+    return C.CString("")
+  }
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  parts, status := split_data(ciphertext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  items := make([]string, len(parts))
+  for idx, part := range parts {
+    items[idx] = hex.EncodeToString(part)
+  }
+  result, err := json.Marshal(items)
+  if err != nil {
+    fail(STATUS_INTERNAL, err)
+    return C.CString("")
+  }
+  return C.CString(string(result))
+}
+
+// join_packages reassembles the output of split_packages into the original
+// hex ciphertext. Returns empty string if an item is not valid hex or not
+// on a package boundary. Caller must free_cstring the result
+//export join_packages
+func join_packages(packages_json *C.char) *C.char {
+  clear_error()
+  defer count_export()
+  if c_null(packages_json) {
+    return C.CString("")
+  }
+  var items []string
+  if err := json.Unmarshal([]byte(C.GoString(packages_json)), &items); err != nil {
+    fail(STATUS_MALFORMED, err)
+    return C.CString("")
+  }
+  parts := make([][]byte, len(items))
+  for idx, item := range items {
+    part, err := decode_hex(item)
+    if err != nil {
+      return C.CString("")
+    }
+    parts[idx] = part
+  }
+  result, status := join_data(parts)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(result))
+}
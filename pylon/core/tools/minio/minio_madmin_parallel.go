@@ -0,0 +1,150 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "crypto/cipher"
+  "encoding/binary"
+  "encoding/hex"
+  "runtime"
+  "sync"
+  "github.com/secure-io/sio-go/sioutil"
+)
+
+const max_workers = 64
+
+// sio package framing, see sio EncWriter: the nonce is the stream nonce
+// followed by a little endian sequence number. Sequence 0 seals the
+// associated data into a tag, which then is the associated data of every
+// package after a flag byte marking the final one
+const (
+  package_flag       = 0x00
+  package_flag_final = 0x80
+)
+
+// package_opener opens single packages of a stream by index, for callers
+// that need more control than the sio DecReader gives
+type package_opener struct {
+  aead  cipher.AEAD
+  nonce []byte
+  ad    []byte
+}
+
+// new_package_opener takes the 8 bytes stream nonce of the header
+func new_package_opener(aead cipher.AEAD, stream_nonce []byte) *package_opener {
+  nonce := make([]byte, aead.NonceSize())
+  copy(nonce, stream_nonce)
+  ad := make([]byte, 1, 1 + aead.Overhead())
+  ad = aead.Seal(ad, nonce, nil, nil)
+  return &package_opener{aead: aead, nonce: nonce, ad: ad}
+}
+
+// open appends the cleartext of package idx to dst
+func (o *package_opener) open(dst []byte, data []byte, idx int, final bool) ([]byte, error) {
+  o.ad[0] = package_flag
+  if final {
+    o.ad[0] = package_flag_final
+  }
+  binary.LittleEndian.PutUint32(o.nonce[len(o.nonce) - 4:], uint32(idx + 1))
+  return o.aead.Open(dst, o.nonce, data, o.ad)
+}
+
+// encrypt_parallel_data produces exactly what encrypt_writer would, sealing
+// packages on workers goroutines. Each package only depends on its index
+func encrypt_parallel_data(secret_key []byte, cleartext []byte, workers int) ([]byte, int) {
+  salt := sioutil.MustRandom(32)
+  id := default_aead()
+  aead, err := new_aead(secret_key, salt, id)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  nonce := make([]byte, aead.NonceSize())
+  copy(nonce, sioutil.MustRandom(aead.NonceSize() - 4))
+  ad := make([]byte, 1, 1 + aead.Overhead())
+  ad = aead.Seal(ad, nonce, nil, nil)
+  count := (len(cleartext) + package_payload - 1) / package_payload
+  if count == 0 {
+    count = 1
+  }
+  if workers > count {
+    workers = count
+  }
+  result := make([]byte, header_size + len(cleartext) + count * aead.Overhead())
+  copy(result, salt)
+  result[32] = id
+  copy(result[33:header_size], nonce)
+  indexes := make(chan int)
+  var group sync.WaitGroup
+  for worker := 0; worker < workers; worker++ {
+    group.Add(1)
+    go func() {
+      defer group.Done()
+      package_nonce := append([]byte{}, nonce...)
+      package_ad := append([]byte{}, ad...)
+      for idx := range indexes {
+        start := idx * package_payload
+        end := start + package_payload
+        package_ad[0] = package_flag
+        if idx == count - 1 {
+          end = len(cleartext)
+          package_ad[0] = package_flag_final
+        }
+        binary.LittleEndian.PutUint32(package_nonce[len(package_nonce) - 4:], uint32(idx + 1))
+        offset := header_size + idx * (package_payload + aead.Overhead())
+        size := end - start + aead.Overhead()
+        aead.Seal(result[offset:offset:offset + size], package_nonce, cleartext[start:end], package_ad)
+      }
+    }()
+  }
+  for idx := 0; idx < count; idx++ {
+    indexes <- idx
+  }
+  close(indexes)
+  group.Wait()
+  return result, STATUS_OK
+}
+
+// encrypt_parallel is encrypt splitting the cleartext into DARE packages
+// sealed by up to workers goroutines (GOMAXPROCS if 0 or less, at most 64).
+// The output is an ordinary madmin ciphertext, decrypt reads it as is.
+// Only pays off for cleartext of many 16 KiB packages.
+// Returns empty string on failure. Caller must free_cstring the result
+//export encrypt_parallel
+func encrypt_parallel(secret_key *C.char, cleartext_hex *C.char, workers C.int) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_parallel", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) {
+    return C.CString("")
+  }
+  count := int(workers)
+  if count <= 0 {
+    count = runtime.GOMAXPROCS(0)
+  }
+  if count > max_workers {
+    count = max_workers
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := encrypt_parallel_data(key, cleartext, count)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
@@ -0,0 +1,72 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "runtime"
+  "testing"
+)
+
+// Run with: go test -tags testutil -run - -bench Parallel .
+
+const parallel_bench_size = 64 << 20
+
+func TestParallelMatchesSerialLayout(t *testing.T) {
+  key := []byte(test_key)
+  for _, size := range []int{0, 1, package_payload, package_payload + 1, 5 * package_payload - 7} {
+    cleartext := bytes.Repeat([]byte{0x5a}, size)
+    parallel, status := encrypt_parallel_data(key, cleartext, 4)
+    if status != STATUS_OK {
+      t.Fatalf("size %d: status %d", size, status)
+    }
+    serial, _ := encrypt_raw(key, cleartext)
+    if len(parallel) != len(serial) {
+      t.Fatalf("size %d: parallel output is %d bytes, serial %d", size, len(parallel), len(serial))
+    }
+    result, status := decrypt_raw(key, parallel)
+    if status != STATUS_OK || !bytes.Equal(result, cleartext) {
+      t.Fatalf("size %d: parallel output decrypted with status %d", size, status)
+    }
+  }
+}
+
+func benchmark_encrypt(b *testing.B, encrypt func(key []byte, cleartext []byte) int) {
+  key := []byte(test_key)
+  cleartext := make([]byte, parallel_bench_size)
+  b.SetBytes(parallel_bench_size)
+  b.ResetTimer()
+  for round := 0; round < b.N; round++ {
+    if status := encrypt(key, cleartext); status != STATUS_OK {
+      b.Fatalf("status %d", status)
+    }
+  }
+}
+
+func BenchmarkParallelSerial(b *testing.B) {
+  benchmark_encrypt(b, func(key []byte, cleartext []byte) int {
+    _, status := encrypt_raw(key, cleartext)
+    return status
+  })
+}
+
+func BenchmarkParallelWorkers(b *testing.B) {
+  benchmark_encrypt(b, func(key []byte, cleartext []byte) int {
+    _, status := encrypt_parallel_data(key, cleartext, runtime.GOMAXPROCS(0))
+    return status
+  })
+}
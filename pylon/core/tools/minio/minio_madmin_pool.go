@@ -0,0 +1,97 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdlib.h>
+// #include <string.h>
+import "C"
+import (
+  "bytes"
+  "encoding/hex"
+  "sync"
+  "unsafe"
+)
+
+// encrypt and decrypt stage hex input and their output in pooled buffers,
+// wiped before reuse. Buffers grown past max_pooled_size are dropped
+// instead of pinning that much memory
+const max_pooled_size = 4 << 20
+
+// buffer_pool has no New, so that pool_reset can tell it is empty
+var buffer_pool sync.Pool
+
+// pool_reset drops the pooled buffers, they were wiped when put back. The
+// pool is drained in place, calls running meanwhile may keep using it
+func pool_reset() {
+  for buffer_pool.Get() != nil {
+  }
+}
+
+func get_buffer() *bytes.Buffer {
+  if buffer, ok := buffer_pool.Get().(*bytes.Buffer); ok {
+    return buffer
+  }
+  return new(bytes.Buffer)
+}
+
+func put_buffer(buffer *bytes.Buffer) {
+  data := buffer.Bytes()
+  wipe(data[:cap(data)])
+  if cap(data) > max_pooled_size {
+    return
+  }
+  buffer.Reset()
+  buffer_pool.Put(buffer)
+}
+
+// c_view views a caller owned C string without copying it, the view must
+// not outlive the call
+func c_view(ptr *C.char) []byte {
+  return c_buffer(unsafe.Pointer(ptr), int(C.strlen(ptr)))
+}
+
+// decode_hex_to is decode_hex decoding into the spare capacity of buffer
+func decode_hex_to(buffer *bytes.Buffer, data []byte) ([]byte, error) {
+  data = bytes.TrimSpace(data)
+  buffer.Grow(len(data) / 2)
+  result := buffer.Bytes()[:len(data) / 2]
+  if _, err := hex.Decode(result, data); err != nil {
+    fail(STATUS_BAD_HEX, err)
+    return nil, err
+  }
+  return result, nil
+}
+
+// c_hex hex encodes data straight into a new C string
+func c_hex(data []byte) *C.char {
+  return c_hex_case(data, false)
+}
+
+// c_hex_case is c_hex with uppercase digits if upper is set
+func c_hex_case(data []byte, upper bool) *C.char {
+  size := hex.EncodedLen(len(data))
+  ptr := C.malloc(C.size_t(size + 1))
+  result := c_buffer(ptr, size + 1)
+  hex.Encode(result, data)
+  if upper {
+    for idx, char := range result[:size] {
+      if char >= 'a' {
+        result[idx] = char - 'a' + 'A'
+      }
+    }
+  }
+  result[size] = 0
+  return (*C.char)(ptr)
+}
@@ -0,0 +1,100 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "encoding/hex"
+  "strings"
+  "testing"
+)
+
+// Run with: go test -tags testutil -run - -bench Pool -benchmem .
+//
+// Both benchmarks stage 1 MiB the way encrypt and decrypt do around the
+// cipher, which is left out as it allocates the same either way: decode
+// the hex input, write the output to a buffer and hex it into a C string
+
+const pool_bench_size = 1 << 20
+
+func benchmark_staging(b *testing.B, stage func(input c_string)) {
+  input := test_cstring(strings.Repeat("a5", pool_bench_size))
+  defer test_free(input)
+  b.SetBytes(pool_bench_size)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for round := 0; round < b.N; round++ {
+    stage(input)
+  }
+}
+
+func BenchmarkPoolStaging(b *testing.B) {
+  benchmark_staging(b, func(input c_string) {
+    in, out := get_buffer(), get_buffer()
+    data, err := decode_hex_to(in, c_view(input))
+    if err != nil {
+      b.Fatal(err)
+    }
+    out.Write(data)
+    free_cstring(c_hex(out.Bytes()))
+    put_buffer(in)
+    put_buffer(out)
+  })
+}
+
+func BenchmarkPoolUnpooled(b *testing.B) {
+  benchmark_staging(b, func(input c_string) {
+    data, err := decode_hex(test_gostring(input))
+    if err != nil {
+      b.Fatal(err)
+    }
+    var out bytes.Buffer
+    out.Write(data)
+    test_free(test_cstring(hex.EncodeToString(out.Bytes())))
+  })
+}
+
+func TestPoolBuffersWipedWhenPutBack(t *testing.T) {
+  buffer := get_buffer()
+  buffer.WriteString(test_key)
+  data := buffer.Bytes()
+  put_buffer(buffer)
+  if !all_zero(data[:cap(data)]) {
+    t.Fatalf("pooled buffer not wiped: %q", data)
+  }
+}
+
+func TestDecryptToGrowsOutputOnce(t *testing.T) {
+  key := []byte(test_key)
+  for _, size := range []int{1, 100, package_payload, 5 * package_payload + 3} {
+    ciphertext, status := encrypt_raw(key, bytes.Repeat([]byte{0x11}, size))
+    if status != STATUS_OK {
+      t.Fatalf("encrypt_raw: status %d", status)
+    }
+    // The array decrypt_to grows to before reading must be the one holding
+    // all of the cleartext
+    buffer := new(bytes.Buffer)
+    grow_output(buffer, ciphertext)
+    array := &buffer.Bytes()[:1][0]
+    if status := decrypt_to(buffer, key, ciphertext, nil); status != STATUS_OK || buffer.Len() != size {
+      t.Fatalf("%d bytes: status %d, %d decrypted", size, status, buffer.Len())
+    }
+    if &buffer.Bytes()[0] != array {
+      t.Errorf("%d bytes: output moved to another array while reading", size)
+    }
+  }
+}
@@ -0,0 +1,66 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "errors"
+  "io"
+  "math"
+)
+
+// decrypt_range_data decrypts only the packages overlapping
+// [offset, offset + length) of the cleartext. sio maps the cleartext offset
+// to package (offset / chunk_size), authenticates the packages it has
+// to read and trims the first and last of them to the requested bounds
+func decrypt_range_data(secret_key []byte, ciphertext []byte, offset int64, length int64, chunk_size int) ([]byte, int) {
+  info := inspect_chunked(ciphertext, chunk_size)
+  if !info.Complete && !empty_ciphertext(ciphertext) {
+    return nil, fail(STATUS_MALFORMED, errors.New(info.Error))
+  }
+  if offset < 0 || length < 0 || length > math.MaxInt32 || offset > info.TotalPayload - length {
+    return nil, fail(STATUS_OUT_OF_RANGE, errors.New("range outside of cleartext"))
+  }
+  if length == 0 {
+    return nil, STATUS_OK
+  }
+  stream, err := new_chunked_stream(secret_key, ciphertext[:32], ciphertext[32], chunk_size)
+  if err != nil {
+    return nil, fail(STATUS_MALFORMED, err)
+  }
+  payload := bytes.NewReader(ciphertext[header_size:])
+  reader := stream.DecryptReaderAt(payload, ciphertext[33:header_size], nil)
+  data := make([]byte, length)
+  if n, err := reader.ReadAt(data, offset); int64(n) != length {
+    wipe(data)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+      return nil, fail(STATUS_MALFORMED, err)
+    }
+    return nil, stream_status(err)
+  }
+  return data, STATUS_OK
+}
+
+// decrypt_range returns length cleartext bytes starting at offset, see
+// encrypt_bytes for out_len and ownership. Only the packages covering the
+// range are decrypted, so it is cheap for a small part of a large object.
+// A range past the end of the cleartext reports STATUS_OUT_OF_RANGE
+//export decrypt_range
+func decrypt_range(secret_key *C.char, ciphertext_hex *C.char, offset C.longlong, length C.longlong, out_len *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_range", secret_key, c_hex_size(ciphertext_hex)).end()
+  return decrypt_range_hex(secret_key, ciphertext_hex, offset, length, 0, out_len)
+}
@@ -0,0 +1,163 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "io"
+  "io/ioutil"
+  "github.com/minio/minio/pkg/madmin"
+  "github.com/secure-io/sio-go"
+  "github.com/secure-io/sio-go/sioutil"
+  "golang.org/x/crypto/hkdf"
+)
+
+const raw_key_length = 32
+
+var raw_key_info = []byte("pylon rawkey")
+
+// raw_key_subkey derives the AEAD key of one ciphertext from the raw key
+// and its salt with HKDF-SHA256. The 64 bit nonce alone would repeat after
+// about 2^32 ciphertexts under a long lived key, the salt keeps them apart
+func raw_key_subkey(raw_key []byte, salt []byte) ([]byte, error) {
+  subkey := make([]byte, raw_key_length)
+  if _, err := io.ReadFull(hkdf.New(sha256.New, raw_key, salt, raw_key_info), subkey); err != nil {
+    return nil, err
+  }
+  return subkey, nil
+}
+
+// raw_key_stream is new_stream with the subkey of raw_key instead of Argon2id
+func raw_key_stream(raw_key []byte, salt []byte, id byte) (*sio.Stream, int) {
+  if len(raw_key) != raw_key_length {
+    return nil, fail(STATUS_BAD_ARG, errors.New("raw key must be 32 bytes"))
+  }
+  subkey, err := raw_key_subkey(raw_key, salt)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  defer wipe(subkey)
+  aead, err := key_aead(subkey, id)
+  if err != nil {
+    return nil, fail(STATUS_MALFORMED, err)
+  }
+  return sio.NewStream(aead, package_payload), STATUS_OK
+}
+
+func encrypt_rawkey_data(raw_key []byte, cleartext []byte) ([]byte, int) {
+  return encrypt_rawkey_seeded(raw_key, cleartext, sioutil.MustRandom(32), sioutil.MustRandom(8))
+}
+
+// encrypt_rawkey_seeded is encrypt_rawkey_data under the given salt and nonce
+func encrypt_rawkey_seeded(raw_key []byte, cleartext []byte, salt []byte, nonce []byte) ([]byte, int) {
+  id := default_aead()
+  stream, status := raw_key_stream(raw_key, salt, id)
+  if status != STATUS_OK {
+    return nil, status
+  }
+  var buffer bytes.Buffer
+  writer, err := stream_writer(stream, &buffer, id, nil, salt, nonce)
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if _, err := writer.Write(cleartext); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  if err := writer.Close(); err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return buffer.Bytes(), STATUS_OK
+}
+
+func decrypt_rawkey_data(raw_key []byte, ciphertext []byte) ([]byte, int) {
+  if empty_ciphertext(ciphertext) {
+    return []byte{}, STATUS_OK
+  }
+  if status := check_header(ciphertext); status != STATUS_OK {
+    return nil, status
+  }
+  stream, status := raw_key_stream(raw_key, ciphertext[:32], ciphertext[32])
+  if status != STATUS_OK {
+    return nil, status
+  }
+  reader := stream.DecryptReader(bytes.NewReader(ciphertext[header_size:]), ciphertext[33:header_size], nil)
+  data, err := ioutil.ReadAll(reader)
+  if err == madmin.ErrMaliciousData {
+    return nil, fail(STATUS_AUTH_FAILED, err)
+  }
+  if err != nil {
+    return nil, fail(STATUS_INTERNAL, err)
+  }
+  return data, STATUS_OK
+}
+
+// encrypt_rawkey is encrypt with a 32 byte hex key, e.g. a data key handed
+// out by a KMS, that skips Argon2id: the AEAD key of each ciphertext is
+// derived from it and the random salt with HKDF-SHA256.
+// The output has the madmin layout but is NOT interchangeable with the
+// passphrase based exports or madmin: only decrypt_rawkey reads it.
+// Returns empty string on failure. Caller must free_cstring the result
+//export encrypt_rawkey
+func encrypt_rawkey(raw_key_hex *C.char, cleartext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("encrypt_rawkey", raw_key_hex, c_hex_size(cleartext_hex)).end()
+  if c_null(raw_key_hex, cleartext_hex) {
+    return C.CString("")
+  }
+  key, err := decode_hex(C.GoString(raw_key_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(key)
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := encrypt_rawkey_data(key, cleartext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// decrypt_rawkey reverses encrypt_rawkey, see the warning there.
+// Caller must free_cstring the result
+//export decrypt_rawkey
+func decrypt_rawkey(raw_key_hex *C.char, ciphertext_hex *C.char) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_rawkey", raw_key_hex, c_hex_size(ciphertext_hex)).end()
+  if c_null(raw_key_hex, ciphertext_hex) {
+    return C.CString("")
+  }
+  key, err := decode_hex(C.GoString(raw_key_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  defer wipe(key)
+  ciphertext, err := decode_hex(C.GoString(ciphertext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  data, status := decrypt_rawkey_data(key, ciphertext)
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  defer wipe(data)
+  return C.CString(hex.EncodeToString(data))
+}
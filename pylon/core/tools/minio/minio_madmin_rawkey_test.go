@@ -0,0 +1,53 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestRawKeySaltSeparatesKeys(t *testing.T) {
+  raw_key := bytes.Repeat([]byte{0x6b}, raw_key_length)
+  cleartext := bytes.Repeat([]byte{0x00}, 100)
+  nonce := bytes.Repeat([]byte{0x4e}, 8)
+  salts := [][]byte{bytes.Repeat([]byte{0x01}, 32), bytes.Repeat([]byte{0x02}, 32)}
+  first, _ := raw_key_subkey(raw_key, salts[0])
+  second, _ := raw_key_subkey(raw_key, salts[1])
+  if bytes.Equal(first, second) || bytes.Equal(first, raw_key) {
+    t.Fatal("subkeys do not depend on the salt")
+  }
+  var bodies [][]byte
+  for _, salt := range salts {
+    ciphertext, status := encrypt_rawkey_seeded(raw_key, cleartext, salt, nonce)
+    if status != STATUS_OK {
+      t.Fatalf("encrypt_rawkey_seeded: status %d", status)
+    }
+    if data, status := decrypt_rawkey_data(raw_key, ciphertext); status != STATUS_OK || !bytes.Equal(data, cleartext) {
+      t.Fatalf("decrypt_rawkey_data: status %d", status)
+    }
+    bodies = append(bodies, ciphertext[header_size:])
+  }
+  // Same nonce and cleartext, so only the subkey can tell the packages apart
+  if bytes.Equal(bodies[0], bodies[1]) {
+    t.Error("same nonce under two salts gave the same keystream")
+  }
+  again, _ := encrypt_rawkey_seeded(raw_key, cleartext, salts[0], nonce)
+  if !bytes.Equal(again[header_size:], bodies[0]) {
+    t.Error("same salt and nonce gave different packages")
+  }
+}
@@ -0,0 +1,55 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+
+// decrypt_best_effort is decrypt_bytes for hex input that, for forensics,
+// keeps the cleartext of the packages before the first one failing to
+// authenticate. Bytes of the failed package and after are never returned.
+// status reports STATUS_OK if the whole ciphertext decrypted, otherwise
+// why it stopped as decrypt_ex would (STATUS_CORRUPT, STATUS_TRUNCATED,
+// STATUS_WRONG_KEY for no authentic package at all). The prefix is
+// returned with out_len its length in both cases, input that is not a
+// ciphertext gives NULL with out_len -STATUS_* as in encrypt_bytes
+//export decrypt_best_effort
+func decrypt_best_effort(secret_key *C.char, ciphertext_hex *C.char, out_len *C.int, status *C.int) *C.char {
+  clear_error()
+  defer audit_begin("decrypt_best_effort", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) || c_null_out(out_len, status) {
+    c_set(out_len, -STATUS_BAD_ARG)
+    c_set(status, STATUS_BAD_ARG)
+    return nil
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  input, output := get_buffer(), get_buffer()
+  defer put_buffer(input)
+  defer put_buffer(output)
+  ciphertext, err := decode_hex_to(input, c_view(ciphertext_hex))
+  if err != nil {
+    *out_len, *status = -STATUS_BAD_HEX, STATUS_BAD_HEX
+    return nil
+  }
+  code := decrypt_split_to(output, key, ciphertext)
+  *status = C.int(code)
+  switch code {
+  case STATUS_OK, STATUS_CORRUPT, STATUS_TRUNCATED, STATUS_WRONG_KEY:
+    *out_len = C.int(output.Len())
+    return c_bytes(output.Bytes())
+  }
+  *out_len = C.int(-code)
+  return nil
+}
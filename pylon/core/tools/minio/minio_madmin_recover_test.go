@@ -0,0 +1,68 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "encoding/hex"
+  "testing"
+)
+
+func TestDecryptBestEffortStopsAtCorruptMiddlePackage(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  // Four full packages, each filled with its own byte, then a final one
+  var plaintext []byte
+  for idx := 1; idx <= 4; idx++ {
+    plaintext = append(plaintext, bytes.Repeat([]byte{byte(idx)}, package_payload)...)
+  }
+  plaintext = append(plaintext, bytes.Repeat([]byte{5}, 100)...)
+  cleartext := test_cstring(hex.EncodeToString(plaintext))
+  defer test_free(cleartext)
+  ciphertext, _ := hex.DecodeString(test_take(encrypt(key, cleartext)))
+  out_len, status := test_new_int(), test_new_int()
+  best_effort := func(secret_key c_string, data []byte) []byte {
+    input := test_cstring(hex.EncodeToString(data))
+    defer test_free(input)
+    return test_take_bytes(decrypt_best_effort(secret_key, input, out_len, status), out_len)
+  }
+  if data := best_effort(key, ciphertext); test_int_of(status) != STATUS_OK || !bytes.Equal(data, plaintext) {
+    t.Fatalf("intact ciphertext: status %d, %d bytes", test_int_of(status), len(data))
+  }
+  // A modified final package reads as truncated, see truncated_status
+  for _, idx := range []int{0, 1, 2, 3} {
+    corrupted := append([]byte(nil), ciphertext...)
+    corrupted[header_size + idx * package_size + 10] ^= 0x80
+    data := best_effort(key, corrupted)
+    if test_int_of(status) != STATUS_CORRUPT || test_int_of(out_len) != idx * package_payload {
+      t.Errorf("package %d corrupted: status %d, out_len %d, want %d and %d", idx, test_int_of(status), test_int_of(out_len), STATUS_CORRUPT, idx * package_payload)
+      continue
+    }
+    if !bytes.Equal(data, plaintext[:idx * package_payload]) {
+      t.Errorf("package %d corrupted: prefix differs from the cleartext", idx)
+    }
+  }
+  // Cut inside the fourth package, the three before it are kept
+  if data := best_effort(key, ciphertext[:header_size + 3 * package_size + 1000]); test_int_of(status) != STATUS_TRUNCATED || !bytes.Equal(data, plaintext[:3 * package_payload]) {
+    t.Errorf("truncated: status %d, out_len %d", test_int_of(status), test_int_of(out_len))
+  }
+  wrong_key := test_cstring(test_key + "!")
+  defer test_free(wrong_key)
+  if data := best_effort(wrong_key, ciphertext); test_int_of(status) != STATUS_WRONG_KEY || test_int_of(out_len) != 0 || len(data) != 0 {
+    t.Errorf("wrong key: status %d, out_len %d", test_int_of(status), test_int_of(out_len))
+  }
+}
@@ -0,0 +1,76 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdlib.h>
+//
+// struct pylon_result {
+//   char* data;
+//   int len;
+//   int status;
+// };
+import "C"
+import (
+  "unsafe"
+)
+
+// make_result bundles data (NULL unless status is STATUS_OK) with its
+// length and status
+func make_result(data []byte, status int) C.struct_pylon_result {
+  var result C.struct_pylon_result
+  result.status = C.int(status)
+  if status == STATUS_OK {
+    result.data = c_bytes(data)
+    result.len = C.int(len(data))
+  }
+  return result
+}
+
+// encrypt_result is encrypt_bytes for hex input returned as one struct
+// pylon_result { char* data; int len; int status; }: raw ciphertext of len
+// bytes and a STATUS_*. data must be released with result_free
+//export encrypt_result
+func encrypt_result(secret_key *C.char, cleartext_hex *C.char) C.struct_pylon_result {
+  clear_error()
+  defer audit_begin("encrypt_result", secret_key, c_hex_size(cleartext_hex)).end()
+  if c_no_key(secret_key) || c_null(cleartext_hex) {
+    return make_result(nil, STATUS_BAD_ARG)
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  return make_result(encrypt_data(key, C.GoString(cleartext_hex)))
+}
+
+// decrypt_result is the decrypt counterpart of encrypt_result, taking hex
+// ciphertext and returning raw cleartext
+//export decrypt_result
+func decrypt_result(secret_key *C.char, ciphertext_hex *C.char) C.struct_pylon_result {
+  clear_error()
+  defer audit_begin("decrypt_result", secret_key, c_hex_size(ciphertext_hex)).end()
+  if c_no_key(secret_key) || c_null(ciphertext_hex) {
+    return make_result(nil, STATUS_BAD_ARG)
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := decrypt_data(key, C.GoString(ciphertext_hex))
+  defer wipe(data)
+  return make_result(data, status)
+}
+
+// result_free releases the data of a pylon_result, NULL data is fine
+//export result_free
+func result_free(result C.struct_pylon_result) {
+  C.free(unsafe.Pointer(result.data))
+}
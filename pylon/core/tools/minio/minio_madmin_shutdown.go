@@ -0,0 +1,53 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "C"
+
+// madmin_shutdown releases the library global state for hosts unloading the
+// shared object: every open handle is released (stream and chain keys and
+// stream buffers are wiped, background jobs are cancelled and waited for),
+// the audit log, metrics, recorded errors and buffer pool are cleared. The
+// library stays usable afterwards as if freshly loaded, except that handles
+// from before are unknown to every export. Returns the number of handles
+// released, which is 0 if the host freed everything it opened. Calls still
+// running meanwhile are safe, though handles they use may turn unknown.
+// Named apart from shutdown(2), which the C side already knows
+//export madmin_shutdown
+func madmin_shutdown() C.int {
+  values := handle_take_all()
+  for _, value := range values {
+    switch value := value.(type) {
+    case *stream_context:
+      value.lock.Lock()
+      value.release()
+      wipe(value.buffer.Bytes())
+      value.buffer.Reset()
+      value.lock.Unlock()
+    case *chain_context:
+      value.lock.Lock()
+      value.release()
+      value.lock.Unlock()
+    case *file_job:
+      value.cancel()
+      <-value.done
+    }
+  }
+  audit_reset()
+  metrics_reset()
+  pool_reset()
+  errors_reset()
+  return C.int(len(values))
+}
@@ -0,0 +1,151 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestShutdownReleasesOpenHandles(t *testing.T) {
+  dir, err := ioutil.TempDir("", "pylon-shutdown")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  in_path := filepath.Join(dir, "in")
+  if err := ioutil.WriteFile(in_path, bytes.Repeat([]byte{0x42}, 4 * package_payload), 0600); err != nil {
+    t.Fatal(err)
+  }
+  in, out := test_cstring(in_path), test_cstring(filepath.Join(dir, "out"))
+  defer test_free(in)
+  defer test_free(out)
+  key := test_cstring(test_key)
+  defer test_free(key)
+  chunk := test_cstring(strings.Repeat("7e", 1000))
+  defer test_free(chunk)
+  madmin_shutdown()
+  out_len := test_new_int()
+  // An encrypt stream holding output, a decrypt stream holding its key
+  // inside the header, a chain, a progress counter and a background job
+  encrypting := encrypt_stream_init(key)
+  test_take_bytes(encrypt_stream_update(encrypting, chunk, 1000, out_len), out_len)
+  decrypting := decrypt_stream_init(key)
+  test_take_bytes(decrypt_stream_update(decrypting, chunk, 10, out_len), out_len)
+  chain := chain_init(key)
+  progress := progress_init()
+  job := encrypt_file_start(key, in, out, 0)
+  opened := []uintptr{uintptr(encrypting), uintptr(decrypting), uintptr(chain), uintptr(progress), uintptr(job)}
+  for _, handle := range opened {
+    if handle == 0 {
+      t.Fatalf("opening handles failed: %s", test_take(last_error()))
+    }
+  }
+  decrypt_key := handle_get(uintptr(decrypting)).(*stream_context).secret_key
+  chain_key := handle_get(uintptr(chain)).(*chain_context).secret_key
+  stream := handle_get(uintptr(encrypting)).(*stream_context)
+  file_job := handle_get(uintptr(job)).(*file_job)
+  if released := madmin_shutdown(); int(released) != len(opened) {
+    t.Fatalf("shutdown released %d handles, want %d", released, len(opened))
+  }
+  if left := len(handle_take_all()); left != 0 {
+    t.Errorf("%d handles left registered", left)
+  }
+  if len(decrypt_key) == 0 || len(chain_key) == 0 {
+    t.Fatal("keys were not held before shutdown")
+  }
+  if !bytes.Equal(decrypt_key, make([]byte, len(decrypt_key))) || !bytes.Equal(chain_key, make([]byte, len(chain_key))) {
+    t.Error("keys not wiped")
+  }
+  if stream.buffer.Len() != 0 {
+    t.Errorf("stream still holds %d bytes of output", stream.buffer.Len())
+  }
+  select {
+  case <-file_job.done:
+  default:
+    t.Error("background job still running")
+  }
+  if log := test_take(drain_audit_log()); log != "[]" {
+    t.Errorf("audit log kept %s", log)
+  }
+  snapshot := read_metrics(t, false)
+  for name, count := range snapshot.Failures {
+    if count != 0 {
+      t.Errorf("metrics kept %d %s failures", count, name)
+    }
+  }
+  if snapshot.EncryptCalls != 0 || snapshot.EncryptBytes != 0 {
+    t.Errorf("metrics kept %+v", snapshot)
+  }
+  // Handles from before are unknown, the library is usable again
+  if test_take_bytes(decrypt_stream_update(decrypting, chunk, 10, out_len), out_len); test_int_of(out_len) != -STATUS_BAD_HANDLE {
+    t.Errorf("old stream handle: out_len %d", test_int_of(out_len))
+  }
+  if status := encrypt_file_wait(job); status != STATUS_BAD_HANDLE {
+    t.Errorf("old job handle: status %d", status)
+  }
+  if test_take(encrypt(key, chunk)) == "" {
+    t.Errorf("encrypt after shutdown: %s", test_take(last_error()))
+  }
+  if released := madmin_shutdown(); released != 0 {
+    t.Errorf("second shutdown released %d handles", released)
+  }
+}
+
+func TestShutdownConcurrentWithEncrypt(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring(strings.Repeat("3f", 1000))
+  defer test_free(cleartext)
+  var running sync.WaitGroup
+  for worker := 0; worker < 4; worker++ {
+    running.Add(1)
+    go func() {
+      defer running.Done()
+      for round := 0; round < 4; round++ {
+        ciphertext := test_cstring(test_take(encrypt(key, cleartext)))
+        result := test_take(decrypt(key, ciphertext))
+        test_free(ciphertext)
+        if result != test_gostring(cleartext) {
+          t.Error("round trip failed while shutting down")
+        }
+      }
+    }()
+  }
+  done := make(chan struct{})
+  go func() {
+    running.Wait()
+    close(done)
+  }()
+  // Run with -race, shutting down for as long as the workers call in
+  for {
+    select {
+    case <-done:
+      madmin_shutdown()
+      return
+    default:
+      madmin_shutdown()
+      time.Sleep(time.Millisecond)
+    }
+  }
+}
@@ -0,0 +1,334 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdint.h>
+import "C"
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "sync"
+)
+
+// Go pointers can not be handed over cgo, so stateful objects are kept
+// in a registry and referenced from C by an opaque non-zero handle.
+// The registry is the only package level mutable state, all access to it
+// goes through handles_lock
+
+var (
+  handles_lock sync.Mutex
+  handles      = map[uintptr]interface{}{}
+  last_handle  uintptr
+)
+
+func handle_put(value interface{}) uintptr {
+  handles_lock.Lock()
+  defer handles_lock.Unlock()
+  last_handle++
+  handles[last_handle] = value
+  return last_handle
+}
+
+func handle_get(handle uintptr) interface{} {
+  handles_lock.Lock()
+  defer handles_lock.Unlock()
+  return handles[handle]
+}
+
+// handle_take removes and returns the value if accept agrees, in one step,
+// so that of several threads releasing the same handle only one gets it
+func handle_take(handle uintptr, accept func(interface{}) bool) interface{} {
+  handles_lock.Lock()
+  defer handles_lock.Unlock()
+  value, ok := handles[handle]
+  if !ok || !accept(value) {
+    return nil
+  }
+  delete(handles, handle)
+  return value
+}
+
+// handle_take_all empties the registry and returns what it held. Handle
+// numbers keep counting up, so stale handles stay unknown afterwards
+func handle_take_all() map[uintptr]interface{} {
+  handles_lock.Lock()
+  defer handles_lock.Unlock()
+  values := handles
+  handles = map[uintptr]interface{}{}
+  return values
+}
+
+func is_stream_context(value interface{}) bool {
+  _, ok := value.(*stream_context)
+  return ok
+}
+
+// stream_context is an incremental encryption or decryption in progress.
+// Output produced by each update is collected in buffer and drained. The
+// whole stream is audited as one call, logged once the handle is released
+// with the size of all input fed
+type stream_context struct {
+  lock       sync.Mutex
+  decrypt    bool
+  secret_key []byte
+  header     []byte
+  writer     io.WriteCloser
+  buffer     bytes.Buffer
+  status     int
+  call       *audit_call
+}
+
+func (ctx *stream_context) update(data []byte) int {
+  if ctx.status != STATUS_OK {
+    return ctx.status
+  }
+  if ctx.decrypt && ctx.writer == nil {
+    // Header is needed to set up decryption, collect it first
+    needed := header_size - len(ctx.header)
+    if len(data) < needed {
+      ctx.header = append(ctx.header, data...)
+      return STATUS_OK
+    }
+    ctx.header = append(ctx.header, data[:needed]...)
+    data = data[needed:]
+    stream, err := new_stream(ctx.secret_key, ctx.header[:32], ctx.header[32])
+    ctx.release()
+    if err != nil {
+      ctx.status = fail(STATUS_MALFORMED, err)
+      return ctx.status
+    }
+    ctx.writer = stream.DecryptWriter(&ctx.buffer, ctx.header[33:], nil)
+  }
+  if _, err := ctx.writer.Write(data); err != nil {
+    ctx.status = stream_status(err)
+  }
+  return ctx.status
+}
+
+func (ctx *stream_context) final() int {
+  if ctx.status != STATUS_OK {
+    return ctx.status
+  }
+  if ctx.writer == nil && len(ctx.header) == 0 {
+    // No input at all, the empty case of empty_ciphertext
+    return STATUS_OK
+  }
+  if ctx.writer == nil {
+    ctx.status = fail(STATUS_MALFORMED, errors.New("stream ended inside the header"))
+    return ctx.status
+  }
+  if err := ctx.writer.Close(); err != nil {
+    ctx.status = stream_status(err)
+  }
+  return ctx.status
+}
+
+// release wipes the key as soon as it is no longer needed
+func (ctx *stream_context) release() {
+  wipe(ctx.secret_key)
+  ctx.secret_key = nil
+}
+
+// drain hands over collected output, see encrypt_bytes for the convention,
+// and wipes the staged copy
+func (ctx *stream_context) drain(status int, out_len *C.int) *C.char {
+  if status != STATUS_OK {
+    *out_len = C.int(-status)
+    return nil
+  }
+  *out_len = C.int(ctx.buffer.Len())
+  result := c_bytes(ctx.buffer.Bytes())
+  ctx.discard()
+  return result
+}
+
+// discard wipes output that was staged but not drained, as on close
+func (ctx *stream_context) discard() {
+  wipe(ctx.buffer.Bytes())
+  ctx.buffer.Reset()
+}
+
+// stream_direction accepts streams of one direction only, so that a handle
+// passed to the exports of the other is refused as it is
+func stream_direction(decrypt bool) func(interface{}) bool {
+  return func(value interface{}) bool {
+    ctx, ok := value.(*stream_context)
+    return ok && ctx.decrypt == decrypt
+  }
+}
+
+// stream_handle_error reports handle, refused by stream_direction(decrypt)
+func stream_handle_error(handle C.uintptr_t, decrypt bool) int {
+  if !is_stream_context(handle_get(uintptr(handle))) {
+    return fail(STATUS_BAD_HANDLE, fmt.Errorf("unknown stream handle %d", uintptr(handle)))
+  }
+  if decrypt {
+    return fail(STATUS_BAD_HANDLE, fmt.Errorf("stream handle %d encrypts", uintptr(handle)))
+  }
+  return fail(STATUS_BAD_HANDLE, fmt.Errorf("stream handle %d decrypts", uintptr(handle)))
+}
+
+// stream_init takes ownership of secret_key and wipes it when done
+func stream_init(secret_key []byte, decrypt bool, call *audit_call) uintptr {
+  ctx := &stream_context{decrypt: decrypt, secret_key: secret_key, call: call}
+  if !decrypt {
+    writer, err := encrypt_writer(secret_key, &ctx.buffer, default_aead(), nil)
+    ctx.release()
+    if err != nil {
+      call.record(fail(STATUS_INTERNAL, err))
+      return 0
+    }
+    ctx.writer = writer
+  }
+  return handle_put(ctx)
+}
+
+// stream_update and stream_final count their own argument and handle
+// failures, those of the stream are counted with its audit record
+func stream_update(handle C.uintptr_t, decrypt bool, data *C.char, data_len C.int, out_len *C.int) *C.char {
+  if c_null_out(out_len) {
+    count_failure(STATUS_BAD_ARG)
+    return nil
+  }
+  input, ok := c_data(data, data_len)
+  if !ok {
+    *out_len = C.int(-count_failure(STATUS_BAD_ARG))
+    return nil
+  }
+  ctx, ok := handle_get(uintptr(handle)).(*stream_context)
+  if !ok || ctx.decrypt != decrypt {
+    *out_len = C.int(-count_failure(stream_handle_error(handle, decrypt)))
+    return nil
+  }
+  ctx.lock.Lock()
+  defer ctx.lock.Unlock()
+  ctx.call.size += int64(len(input))
+  return ctx.drain(ctx.update(input), out_len)
+}
+
+func stream_final(handle C.uintptr_t, decrypt bool, out_len *C.int) *C.char {
+  if c_null_out(out_len) {
+    count_failure(STATUS_BAD_ARG)
+    return nil
+  }
+  ctx, ok := handle_take(uintptr(handle), stream_direction(decrypt)).(*stream_context)
+  if !ok {
+    *out_len = C.int(-count_failure(stream_handle_error(handle, decrypt)))
+    return nil
+  }
+  ctx.lock.Lock()
+  defer ctx.lock.Unlock()
+  ctx.release()
+  status := ctx.final()
+  ctx.call.record(status)
+  result := ctx.drain(status, out_len)
+  ctx.discard()
+  return result
+}
+
+// stream_free ignores unknown handles but counts one of the other direction,
+// which it leaves open
+func stream_free(handle C.uintptr_t, decrypt bool) {
+  ctx, ok := handle_take(uintptr(handle), stream_direction(decrypt)).(*stream_context)
+  if !ok {
+    if is_stream_context(handle_get(uintptr(handle))) {
+      count_failure(stream_handle_error(handle, decrypt))
+    }
+    return
+  }
+  ctx.lock.Lock()
+  defer ctx.lock.Unlock()
+  ctx.release()
+  ctx.discard()
+  // Released unfinished, unless it had failed already
+  if ctx.status == STATUS_OK {
+    ctx.status = STATUS_CANCELLED
+  }
+  ctx.call.record(ctx.status)
+}
+
+// encrypt_stream_init starts incremental encryption and returns a handle,
+// or 0 on failure. The handle is released by encrypt_stream_final
+// or encrypt_stream_free. The encrypt_stream_* and decrypt_stream_* exports
+// refuse each other's handles with STATUS_BAD_HANDLE, leaving them open
+//export encrypt_stream_init
+func encrypt_stream_init(secret_key *C.char) C.uintptr_t {
+  clear_error()
+  call := audit_begin("encrypt_stream", secret_key, 0)
+  if c_no_key(secret_key) {
+    call.end()
+    return 0
+  }
+  return C.uintptr_t(stream_init(c_secret(secret_key), false, call))
+}
+
+// encrypt_stream_update feeds data and returns the ciphertext produced so far,
+// see encrypt_bytes for out_len and ownership
+//export encrypt_stream_update
+func encrypt_stream_update(handle C.uintptr_t, data *C.char, data_len C.int, out_len *C.int) *C.char {
+  clear_error()
+  return stream_update(handle, false, data, data_len, out_len)
+}
+
+// encrypt_stream_final returns the remaining ciphertext and releases the handle
+//export encrypt_stream_final
+func encrypt_stream_final(handle C.uintptr_t, out_len *C.int) *C.char {
+  clear_error()
+  return stream_final(handle, false, out_len)
+}
+
+// encrypt_stream_free releases the handle without finishing the stream
+//export encrypt_stream_free
+func encrypt_stream_free(handle C.uintptr_t) {
+  clear_error()
+  stream_free(handle, false)
+}
+
+// decrypt_stream_init starts incremental decryption, see encrypt_stream_init.
+// Plaintext is only returned once it has been authenticated
+//export decrypt_stream_init
+func decrypt_stream_init(secret_key *C.char) C.uintptr_t {
+  clear_error()
+  call := audit_begin("decrypt_stream", secret_key, 0)
+  if c_no_key(secret_key) {
+    call.end()
+    return 0
+  }
+  return C.uintptr_t(stream_init(c_secret(secret_key), true, call))
+}
+
+// decrypt_stream_update feeds ciphertext, see encrypt_stream_update
+//export decrypt_stream_update
+func decrypt_stream_update(handle C.uintptr_t, data *C.char, data_len C.int, out_len *C.int) *C.char {
+  clear_error()
+  return stream_update(handle, true, data, data_len, out_len)
+}
+
+// decrypt_stream_final authenticates the end of the stream, returns
+// the remaining plaintext and releases the handle
+//export decrypt_stream_final
+func decrypt_stream_final(handle C.uintptr_t, out_len *C.int) *C.char {
+  clear_error()
+  return stream_final(handle, true, out_len)
+}
+
+// decrypt_stream_free releases the handle without finishing the stream
+//export decrypt_stream_free
+func decrypt_stream_free(handle C.uintptr_t) {
+  clear_error()
+  stream_free(handle, true)
+}
@@ -0,0 +1,296 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "bytes"
+  "runtime"
+  "strings"
+  "testing"
+)
+
+// Run with: go test -tags testutil .
+
+const test_key = "minioadmin"
+
+// heap_growth runs call rounds times and returns how much the C heap grew
+func heap_growth(rounds int, call func()) int64 {
+  call()
+  runtime.GC()
+  before := test_heap_in_use()
+  for round := 0; round < rounds; round++ {
+    call()
+  }
+  runtime.GC()
+  return test_heap_in_use() - before
+}
+
+func TestFreeCstringReleasesResults(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring(strings.Repeat("00", 1 << 20))
+  defer test_free(cleartext)
+  // Each round returns about 2 MiB of hex, 16 leaked rounds would be 32 MiB
+  growth := heap_growth(16, func() {
+    ciphertext := encrypt(key, cleartext)
+    if test_gostring(ciphertext) == "" {
+      t.Fatal("encrypt failed")
+    }
+    free_cstring(ciphertext)
+  })
+  if growth > 4 << 20 {
+    t.Fatalf("C heap grew by %d bytes over 16 encrypt/free_cstring rounds", growth)
+  }
+}
+
+func TestFreeCstringHeapCheckSeesLeaks(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring(strings.Repeat("00", 1 << 20))
+  defer test_free(cleartext)
+  leaked := test_cstring_list()
+  growth := heap_growth(4, func() {
+    leaked = append(leaked, encrypt(key, cleartext))
+  })
+  for _, result := range leaked {
+    free_cstring(result)
+  }
+  if growth < 8 << 20 {
+    t.Fatalf("C heap grew by only %d bytes over 4 leaked results", growth)
+  }
+}
+
+func TestFreeCstringAcceptsNull(t *testing.T) {
+  free_cstring(nil)
+}
+
+func all_zero(data []byte) bool {
+  for _, value := range data {
+    if value != 0 {
+      return false
+    }
+  }
+  return true
+}
+
+func TestWipeZeroesInPlace(t *testing.T) {
+  key := []byte(test_key)
+  view := key[2:6]
+  wipe(key)
+  if !all_zero(key) || !all_zero(view) {
+    t.Fatalf("key not zeroed: %q", key)
+  }
+}
+
+func TestSecureFreeZeroesBeforeFree(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  // A raw result holding a NUL, wiped for out_len bytes
+  plaintext := []byte("secret\x00cleartext")
+  data, data_len := test_bytes(plaintext)
+  defer test_free(data)
+  ciphertext_len, out_len := test_new_int(), test_new_int()
+  ciphertext := encrypt_bytes(key, data, data_len, ciphertext_len)
+  defer test_free(ciphertext)
+  result := decrypt_bytes(key, ciphertext, *ciphertext_len, out_len)
+  if !bytes.Equal(test_peek(result, test_int_of(out_len)), plaintext) {
+    t.Fatalf("decrypt_bytes: out_len %d", test_int_of(out_len))
+  }
+  secure_wipe(result, *out_len)
+  if region := test_peek(result, len(plaintext)); !all_zero(region) {
+    t.Errorf("raw result not zeroed: %q", region)
+  }
+  secure_free(result, *out_len)
+  // A string, wiped up to its NUL
+  secret := test_cstring("key material")
+  secure_wipe(secret, -1)
+  if region := test_peek(secret, len("key material")); !all_zero(region) {
+    t.Errorf("string not zeroed: %q", region)
+  }
+  secure_free(secret, -1)
+  // Nothing past length is touched
+  region, _ := test_bytes([]byte("abcdefgh"))
+  defer test_free(region)
+  secure_wipe(region, 4)
+  if wiped := test_peek(region, 8); !bytes.Equal(wiped, []byte("\x00\x00\x00\x00efgh")) {
+    t.Errorf("wiped %q", wiped)
+  }
+  secure_free(nil, -1)
+  cleartext := test_cstring(strings.Repeat("00", 1 << 20))
+  defer test_free(cleartext)
+  if growth := heap_growth(16, func() { secure_free(encrypt(key, cleartext), -1) }); growth > 4 << 20 {
+    t.Errorf("C heap grew by %d bytes over 16 encrypt/secure_free rounds", growth)
+  }
+}
+
+func TestStreamKeyZeroedAfterUse(t *testing.T) {
+  for _, decrypt := range []bool{false, true} {
+    key := []byte(test_key)
+    handle := stream_init(key, decrypt, &audit_call{operation: "stream"})
+    if handle == 0 {
+      t.Fatal("stream_init failed")
+    }
+    if !decrypt && !all_zero(key) {
+      t.Fatalf("encryption key not zeroed once the stream is keyed: %q", key)
+    }
+    out_len := test_new_int()
+    free_cstring(stream_final(test_uintptr(handle), decrypt, out_len))
+    if !all_zero(key) {
+      t.Fatalf("key not zeroed after final (decrypt %v): %q", decrypt, key)
+    }
+  }
+}
+
+func TestStreamRefusesOtherDirection(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  data, size := test_bytes([]byte("cleartext"))
+  defer test_free(data)
+  out_len := test_new_int()
+  encrypting, decrypting := encrypt_stream_init(key), decrypt_stream_init(key)
+  defer encrypt_stream_free(encrypting)
+  defer decrypt_stream_free(decrypting)
+  test_take_bytes(decrypt_stream_update(encrypting, data, size, out_len), out_len)
+  if test_int_of(out_len) != -STATUS_BAD_HANDLE {
+    t.Errorf("decrypt_stream_update of an encrypt handle: out_len %d", test_int_of(out_len))
+  }
+  test_take_bytes(encrypt_stream_final(decrypting, out_len), out_len)
+  if test_int_of(out_len) != -STATUS_BAD_HANDLE {
+    t.Errorf("encrypt_stream_final of a decrypt handle: out_len %d", test_int_of(out_len))
+  }
+  decrypt_stream_free(encrypting)
+  encrypt_stream_free(decrypting)
+  // Both are left open and keep working in their own direction
+  test_take_bytes(encrypt_stream_update(encrypting, data, size, out_len), out_len)
+  if test_int_of(out_len) < 0 {
+    t.Errorf("encrypt handle after misuse: out_len %d", test_int_of(out_len))
+  }
+  test_take_bytes(decrypt_stream_update(decrypting, data, size, out_len), out_len)
+  if test_int_of(out_len) < 0 {
+    t.Errorf("decrypt handle after misuse: out_len %d", test_int_of(out_len))
+  }
+}
+
+func TestDecryptStreamWipesStagedOutput(t *testing.T) {
+  ciphertext, status := encrypt_raw([]byte(test_key), bytes.Repeat([]byte("s"), 2 * package_payload + 1))
+  if status != STATUS_OK {
+    t.Fatalf("encrypt: status %d", status)
+  }
+  // The first package authenticates and is staged, the second fails
+  ciphertext[header_size + package_size] ^= 1
+  key := test_cstring(test_key)
+  defer test_free(key)
+  handle := decrypt_stream_init(key)
+  ctx := handle_get(uintptr(handle)).(*stream_context)
+  data, size := test_bytes(ciphertext)
+  defer test_free(data)
+  out_len := test_new_int()
+  if test_take_bytes(decrypt_stream_update(handle, data, size, out_len), out_len); test_int_of(out_len) != -STATUS_AUTH_FAILED {
+    t.Fatalf("update of a modified stream: out_len %d", test_int_of(out_len))
+  }
+  staged := ctx.buffer.Bytes()
+  if len(staged) == 0 {
+    t.Fatal("no cleartext staged before the failure")
+  }
+  test_take_bytes(decrypt_stream_final(handle, out_len), out_len)
+  if !all_zero(staged) || ctx.buffer.Len() != 0 {
+    t.Error("staged cleartext survived the close")
+  }
+}
+
+func TestCanDecryptValidatesWholeHex(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring(strings.Repeat("ab", 2 * package_payload))
+  defer test_free(cleartext)
+  ciphertext := test_take(encrypt(key, cleartext))
+  for _, bad := range []string{ciphertext[:len(ciphertext) - 1] + "z", ciphertext[:len(ciphertext) - 1] + " "} {
+    input := test_cstring(bad)
+    result := can_decrypt(key, input)
+    test_free(input)
+    if result != -STATUS_BAD_HEX {
+      t.Errorf("bad last digit %q: can_decrypt gave %d, want %d", bad[len(bad) - 1:], result, -STATUS_BAD_HEX)
+    }
+  }
+  input := test_cstring(ciphertext)
+  defer test_free(input)
+  if result := can_decrypt(key, input); result != 1 {
+    t.Errorf("valid ciphertext: can_decrypt gave %d", result)
+  }
+}
+
+func TestDecryptWipeZeroesCallerKey(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  cleartext := test_cstring("00ff")
+  defer test_free(cleartext)
+  ciphertext := test_cstring(test_take(encrypt(key, cleartext)))
+  defer test_free(ciphertext)
+  status := test_new_int()
+  for _, wipe_key := range []int{0, 1} {
+    result := test_take(decrypt_wipe(key, ciphertext, test_int(wipe_key), status))
+    if test_int_of(status) != STATUS_OK || result != "00ff" {
+      t.Fatalf("decrypt_wipe(%d) gave %q, status %d", wipe_key, result, test_int_of(status))
+    }
+    if left := test_gostring(key); (wipe_key == 0) != (left == test_key) {
+      t.Fatalf("decrypt_wipe(%d) left caller key %q", wipe_key, left)
+    }
+  }
+}
+
+func TestHexInputValidation(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  plain := test_cstring("0102")
+  ciphertext_hex := test_take(encrypt(key, plain))
+  test_free(plain)
+  status := test_new_int()
+  cases := []struct {
+    name    string
+    decrypt bool
+    input   string
+    status  int
+  }{
+    {"odd length cleartext", false, "012", STATUS_BAD_HEX},
+    {"non-hex cleartext", false, "01zz", STATUS_BAD_HEX},
+    {"trailing newline cleartext", false, "0102\n", STATUS_OK},
+    {"surrounding whitespace cleartext", false, " \t0102\r\n", STATUS_OK},
+    {"odd length ciphertext", true, ciphertext_hex[1:], STATUS_BAD_HEX},
+    {"non-hex ciphertext", true, "g" + ciphertext_hex[1:], STATUS_BAD_HEX},
+    {"trailing newline ciphertext", true, ciphertext_hex + "\n", STATUS_OK},
+    {"inner newline ciphertext", true, ciphertext_hex[:10] + "\n" + ciphertext_hex[10:], STATUS_BAD_HEX},
+  }
+  for _, test := range cases {
+    input := test_cstring(test.input)
+    var result string
+    if test.decrypt {
+      result = test_take(decrypt_ex(key, input, status))
+    } else {
+      result = test_take(encrypt_ex(key, input, status))
+    }
+    test_free(input)
+    if test_int_of(status) != test.status {
+      t.Errorf("%s: status %d, want %d", test.name, test_int_of(status), test.status)
+    }
+    if test.status == STATUS_BAD_HEX && (result != "" || test_take(last_error()) == "") {
+      t.Errorf("%s: gave %q without recording an error", test.name, result)
+    }
+    if test.decrypt && test.status == STATUS_OK && result != "0102" {
+      t.Errorf("%s: decrypted to %q", test.name, result)
+    }
+  }
+}
@@ -0,0 +1,146 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// #include <stdint.h>
+// #include <stdlib.h>
+// #include <malloc.h>
+//
+// static size_t heap_in_use(void) {
+// #if __GLIBC__ > 2 || (__GLIBC__ == 2 && __GLIBC_MINOR__ >= 33)
+//   struct mallinfo2 info = mallinfo2();
+// #else
+//   struct mallinfo info = mallinfo();
+// #endif
+//   return (size_t) info.uordblks + (size_t) info.hblkhd;
+// }
+import "C"
+import (
+  "encoding/hex"
+  "errors"
+  "unsafe"
+)
+
+// encrypt_deterministic is encrypt with the salt and nonce taken from
+// nonce_hex (40 bytes: 32 salt followed by 8 nonce) instead of crypto/rand,
+// so the same inputs always give the same ciphertext. For golden-file tests
+// only: reusing a nonce with the same key breaks the encryption.
+// UNSAFE FOR PRODUCTION, thus only compiled with -tags testutil, see
+// encrypt_with_entropy for caller supplied randomness.
+// Returns empty string on failure. Caller must free_cstring the result
+//export encrypt_deterministic
+func encrypt_deterministic(secret_key *C.char, cleartext_hex *C.char, nonce_hex *C.char) *C.char {
+  clear_error()
+  if c_no_key(secret_key) || c_null(cleartext_hex, nonce_hex) {
+    return C.CString("")
+  }
+  seed, err := decode_hex(C.GoString(nonce_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  if len(seed) != entropy_size {
+    fail(STATUS_BAD_HEX, errors.New("nonce must be 40 bytes"))
+    return C.CString("")
+  }
+  cleartext, err := decode_hex(C.GoString(cleartext_hex))
+  if err != nil {
+    return C.CString("")
+  }
+  key := c_secret(secret_key)
+  defer wipe(key)
+  data, status := encrypt_seeded_data(key, cleartext, seed[:32], seed[32:])
+  if status != STATUS_OK {
+    return C.CString("")
+  }
+  return C.CString(hex.EncodeToString(data))
+}
+
+// The helpers below give the tests, which can not use cgo themselves,
+// access to C strings, ints and memory
+
+// c_string and c_int name the C types for the tests
+type (
+  c_string = *C.char
+  c_int    = C.int
+)
+
+func test_cstring(value string) *C.char {
+  return C.CString(value)
+}
+
+func test_gostring(ptr *C.char) string {
+  return C.GoString(ptr)
+}
+
+// test_cstring_list is an empty list to collect results in
+func test_cstring_list() []*C.char {
+  return nil
+}
+
+// test_take returns the Go copy of a C string result and frees it
+func test_take(ptr *C.char) string {
+  defer free_cstring(ptr)
+  return C.GoString(ptr)
+}
+
+// test_take_bytes is test_take for raw byte results of size bytes
+func test_take_bytes(ptr *C.char, size *C.int) []byte {
+  defer free_cstring(ptr)
+  if ptr == nil || *size < 0 {
+    return nil
+  }
+  return C.GoBytes(unsafe.Pointer(ptr), *size)
+}
+
+// test_peek copies size bytes at ptr, which stays allocated
+func test_peek(ptr *C.char, size int) []byte {
+  return C.GoBytes(unsafe.Pointer(ptr), C.int(size))
+}
+
+// test_bytes copies data into C memory, test_free releases it
+func test_bytes(data []byte) (*C.char, C.int) {
+  return c_bytes(data), C.int(len(data))
+}
+
+func test_free(ptr *C.char) {
+  C.free(unsafe.Pointer(ptr))
+}
+
+func test_int(value int) C.int {
+  return C.int(value)
+}
+
+func test_longlong(value int64) C.longlong {
+  return C.longlong(value)
+}
+
+func test_uintptr(value uintptr) C.uintptr_t {
+  return C.uintptr_t(value)
+}
+
+func test_int_of(ptr *C.int) int {
+  return int(*ptr)
+}
+
+func test_new_int() *C.int {
+  return new(C.int)
+}
+
+// test_heap_in_use is the number of bytes currently allocated with malloc
+func test_heap_in_use() int64 {
+  return int64(C.heap_in_use())
+}
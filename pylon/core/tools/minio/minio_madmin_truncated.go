@@ -0,0 +1,85 @@
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import "crypto/cipher"
+
+// truncated_status tells whether ciphertext, which failed to decrypt after
+// yielding decrypted bytes, ends in the middle of the stream. Input ending
+// inside the header or inside a tag is truncated by structure. A stream cut
+// on a package boundary is proven truncated when its last package opens as
+// a non-final one. A cut inside the last package can not be told from a
+// modified last package, it is reported as truncated once every earlier
+// package authenticated. Returns STATUS_TRUNCATED or STATUS_OK
+func truncated_status(aead cipher.AEAD, ciphertext []byte, decrypted int) int {
+  if len(ciphertext) == 0 {
+    return STATUS_OK
+  }
+  if len(ciphertext) <= header_size {
+    return STATUS_TRUNCATED
+  }
+  if check_header(ciphertext) != STATUS_OK {
+    return STATUS_OK
+  }
+  payload := len(ciphertext) - header_size
+  full, rest := payload / package_size, payload % package_size
+  if rest > 0 && rest < package_overhead {
+    return STATUS_TRUNCATED
+  }
+  if rest > 0 {
+    if full > 0 && decrypted == full * package_payload {
+      return STATUS_TRUNCATED
+    }
+    return STATUS_OK
+  }
+  if decrypted != (full - 1) * package_payload || !opens_non_final(aead, ciphertext, full - 1) {
+    return STATUS_OK
+  }
+  return STATUS_TRUNCATED
+}
+
+// opens_non_final authenticates full package idx as one followed by more
+func opens_non_final(aead cipher.AEAD, ciphertext []byte, idx int) bool {
+  if aead == nil {
+    return false
+  }
+  offset := header_size + idx * package_size
+  opener := new_package_opener(aead, ciphertext[33:header_size])
+  cleartext, err := opener.open(nil, ciphertext[offset:offset + package_size], idx, false)
+  wipe(cleartext)
+  return err == nil
+}
+
+// opens_package authenticates package idx, final or not, on its own. It
+// proves the key right whatever happened to the packages before it
+func opens_package(aead cipher.AEAD, ciphertext []byte, idx int) bool {
+  offset := header_size + idx * package_size
+  if aead == nil || len(ciphertext) < offset + package_overhead {
+    return false
+  }
+  end := offset + package_size
+  if end > len(ciphertext) {
+    end = len(ciphertext)
+  }
+  opener := new_package_opener(aead, ciphertext[33:header_size])
+  for _, final := range []bool{false, true} {
+    cleartext, err := opener.open(nil, ciphertext[offset:end], idx, final)
+    wipe(cleartext)
+    if err == nil {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,75 @@
+// +build testutil
+
+package main
+
+//   Copyright 2020 getcarrier.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+import (
+  "encoding/hex"
+  "encoding/json"
+  "strings"
+  "testing"
+)
+
+func TestDecryptExReportsChoppedCiphertextTruncated(t *testing.T) {
+  key := test_cstring(test_key)
+  defer test_free(key)
+  // Two full packages then a final one of 100 bytes
+  cleartext := test_cstring(strings.Repeat("c3", 2 * package_payload + 100))
+  defer test_free(cleartext)
+  ciphertext, _ := hex.DecodeString(test_take(encrypt(key, cleartext)))
+  status := test_new_int()
+  second := header_size + package_size
+  third := header_size + 2 * package_size
+  // Only cuts leaving no room for a tag are visible without the key
+  for _, cut := range []struct {
+    name       string
+    at         int
+    structural bool
+  }{
+    {"inside the salt", 1, true},
+    {"inside the nonce", header_size - 1, true},
+    {"right after the header", header_size, true},
+    {"inside the first package", header_size + 1, true},
+    {"on the first boundary", second, false},
+    {"inside the second package", second + package_overhead, false},
+    {"in the middle of the second package", second + package_size / 2, false},
+    {"inside the second tag", third - 1, false},
+    {"on the second boundary", third, false},
+    {"inside the final tag", third + package_overhead - 1, true},
+    {"inside the final package", len(ciphertext) - 1, false},
+  } {
+    chopped := test_cstring(hex.EncodeToString(ciphertext[:cut.at]))
+    result := test_take(decrypt_ex(key, chopped, status))
+    if test_int_of(status) != STATUS_TRUNCATED || result != "" {
+      t.Errorf("chopped %s (%d bytes): status %d, want %d", cut.name, cut.at, test_int_of(status), STATUS_TRUNCATED)
+    }
+    var info inspect_info
+    if err := json.Unmarshal([]byte(test_take(inspect(chopped))), &info); err != nil {
+      t.Fatal(err)
+    }
+    if info.Complete == cut.structural {
+      t.Errorf("chopped %s: inspect complete %v", cut.name, info.Complete)
+    }
+    test_free(chopped)
+  }
+  // Without an earlier package to vouch for the key, a cut inside the
+  // first one can not be told from a wrong key
+  chopped := test_cstring(hex.EncodeToString(ciphertext[:second - 1]))
+  defer test_free(chopped)
+  if result := test_take(decrypt_ex(key, chopped, status)); test_int_of(status) != STATUS_WRONG_KEY || result != "" {
+    t.Errorf("chopped inside the first tag: status %d, want %d", test_int_of(status), STATUS_WRONG_KEY)
+  }
+}